@@ -1,46 +1,436 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	ftp_op "github.com/thenets/ftp-datasync/ftp-op"
 )
 
+// Exit codes returned by the CLI, one for each kind of failure
+const (
+	exitOK = iota
+	exitUsage
+	exitConfig
+	exitConnection
+	exitList
+	exitDownload
+	exitDelete
+	exitDeleteGuard
+	exitCompress
+	exitReport
+	exitUpload
+	exitUnknown
+)
+
+// Commands of the CLI
+const (
+	commandRun      = "run"
+	commandSync     = "sync"
+	commandCompress = "compress"
+	commandReport   = "report"
+	commandStatus   = "status"
+	commandValidate = "validate"
+	commandDaemon   = "daemon"
+)
+
+var commands = []string{commandRun, commandSync, commandCompress, commandReport, commandStatus, commandValidate, commandDaemon}
+
+// logger receives the progress messages and errors
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
 func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	flags := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	configFilePath := flags.String("config", "", "config file path")
+	reportFilePath := flags.String("report", "", "compress report destination file path (run, report and daemon commands)")
+	jobs := flags.String("job", "", "comma separated names of the jobs to run (default: all jobs of the config file)")
+	dryRun := flags.Bool("dry-run", false, "print the planned downloads, deletions and compressions without touching the disk")
+	forceDelete := flags.Bool("force-delete", false, "ignore the mass deletion guard thresholds")
+	verbose := flags.Bool("v", false, "also log the files skipped because they are excluded or didn't change")
+	quiet := flags.Bool("q", false, "only log warnings and errors")
+	logFormat := flags.String("log-format", "text", "log format, 'text' or 'json'")
+	metricsTextfile := flags.String("metrics-textfile", "", "write the Prometheus metrics of the run to this node_exporter textfile")
+	metricsAddr := flags.String("metrics-addr", "", "serve the Prometheus metrics on '/metrics' at this address, like ':9100' (daemon command)")
+	flags.Usage = func() { usage(flags) }
+
+	args, err := parseArgs(flags, os.Args[1:])
+	if err != nil {
+		return exitUsage
+	}
+	command := commandRun
+	if len(args) > 0 && isCommand(args[0]) {
+		command, args = args[0], args[1:]
+	}
+
+	// The config and report paths can also be positional, like in
+	// './ftpdatasync config.yml report.csv'
+	if *configFilePath == "" && len(args) > 0 {
+		*configFilePath, args = args[0], args[1:]
+	}
+	needsReport := command == commandRun || command == commandReport || command == commandDaemon
+	if needsReport && *reportFilePath == "" && len(args) > 0 {
+		*reportFilePath, args = args[0], args[1:]
+	}
+
+	problem := ""
+	switch {
+	case len(args) > 0:
+		problem = fmt.Sprintf("unexpected arguments: %s", strings.Join(args, " "))
+	case *configFilePath == "":
+		problem = "config file path not supplied!"
+	case needsReport && *reportFilePath == "":
+		problem = "report destination file path not supplied!"
+	case *verbose && *quiet:
+		problem = "'-v' and '-q' can't be used together"
+	case *metricsAddr != "" && command != commandDaemon:
+		problem = "'-metrics-addr' can only be used by the daemon command"
+	case *logFormat != "text" && *logFormat != "json":
+		problem = fmt.Sprintf("invalid log format '%s' (expected 'text' or 'json')", *logFormat)
+	}
+	if problem != "" {
+		fmt.Fprintln(os.Stderr, "[ERROR]", problem)
+		flags.Usage()
+		return exitUsage
+	}
+
+	// Logs go to stderr, so the output of 'status' can be piped
+	options := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if *verbose {
+		options.Level = slog.LevelDebug
+	} else if *quiet {
+		options.Level = slog.LevelWarn
+	}
+	if *logFormat == "json" {
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, options))
+	} else {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, options))
+	}
+
+	// Check the config file without connecting
+	if command == commandValidate {
+		return validate(*configFilePath, *jobs)
+	}
 
-	if len(os.Args) != 3 {
-		fmt.Println("[ERROR] arguments not supplied!")
-		fmt.Println("How to use:")
-		fmt.Println("./ftpdatasync <configFilePath> <reportDestinationFilePath>")
-	
-		return
+	// Select jobs
+	logger.Debug("Load config file", "path", *configFilePath)
+	jobNames, err := selectJobs(*configFilePath, *jobs)
+	if err != nil {
+		return fail(logger, err)
 	}
 
-	// Load args
-	configFilePath := os.Args[1]
-	reportDestinationFilePath := os.Args[2]
+	// Download speed limit shared by all jobs
+	rateLimiter, err := ftp_op.NewRateLimiter(*configFilePath)
+	if err != nil {
+		return fail(logger, err)
+	}
+
+	var metrics *ftp_op.Metrics
+	if *metricsTextfile != "" || *metricsAddr != "" {
+		metrics = ftp_op.NewMetrics()
+	}
+
+	var contexts []*ftp_op.ServerContext
+	for _, jobName := range jobNames {
+		context := &ftp_op.ServerContext{
+			ConfigFilePath: *configFilePath,
+			JobName:        jobName,
+			DryRun:         *dryRun,
+			ForceDelete:    *forceDelete,
+			Logger:         logger,
+			Metrics:        metrics,
+
+			GlobalRateLimiter: rateLimiter,
+		}
+		context.Progress = downloadProgress(jobLogger(context, command))
+		// Open the state database read only, without creating it
+		if command == commandStatus {
+			context.DryRun = true
+		}
+		contexts = append(contexts, context)
+	}
+
+	if command == commandDaemon {
+		return daemon(contexts, *reportFilePath, metrics, *metricsAddr, *metricsTextfile)
+	}
+
+	// Run every job, even if a previous one failed
+	exitCode := exitOK
+	for _, context := range contexts {
+		code := runJob(context, command, jobReportFilePath(*reportFilePath, context.JobName))
+		if exitCode == exitOK {
+			exitCode = code
+		}
+	}
+
+	// Export the metrics of all jobs, even the failed ones
+	if metrics != nil {
+		if err := metrics.WriteTextfile(*metricsTextfile); err != nil {
+			logger.Error("Can't write the metrics", "path", *metricsTextfile, "error", err)
+		}
+	}
+
+	return exitCode
+}
 
-	// Load config and create context
-	fmt.Printf("# Load config file...\n")
-	context := ftp_op.ServerContext{
-		ConfigFilePath: configFilePath,
+func isCommand(name string) bool {
+	for _, command := range commands {
+		if name == command {
+			return true
+		}
 	}
+	return false
+}
+
+// usage prints the commands and flags of the CLI
+func usage(flags *flag.FlagSet) {
+	fmt.Fprintln(os.Stderr, "How to use:")
+	fmt.Fprintln(os.Stderr, "./ftpdatasync [<command>] [<flags>] [<configFilePath> [<reportDestinationFilePath>]]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  run       sync, compress and write the report (default)")
+	fmt.Fprintln(os.Stderr, "  sync      sync the remote and local directories")
+	fmt.Fprintln(os.Stderr, "  compress  compress the local directory, without connecting")
+	fmt.Fprintln(os.Stderr, "  report    write the compress report, without connecting")
+	fmt.Fprintln(os.Stderr, "  status    print the state of the last runs, without connecting")
+	fmt.Fprintln(os.Stderr, "  validate  check the config file, without connecting")
+	fmt.Fprintln(os.Stderr, "  daemon    run the jobs on their 'schedule' or 'interval' until stopped")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Flags:")
+	flags.PrintDefaults()
+}
+
+// validate checks the config of every selected job without connecting
+func validate(configFilePath string, jobs string) int {
+	jobNames, err := selectJobs(configFilePath, jobs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		return errorExitCode(err)
+	}
+
+	exitCode := exitOK
+	if _, err := ftp_op.NewRateLimiter(configFilePath); err != nil {
+		fmt.Fprintln(os.Stderr, "[ERROR]", err)
+		exitCode = errorExitCode(err)
+	}
+	for _, jobName := range jobNames {
+		context := ftp_op.ServerContext{
+			ConfigFilePath: configFilePath,
+			JobName:        jobName,
+		}
+		if err := context.Validate(); err != nil {
+			if jobName != "" {
+				fmt.Fprintf(os.Stderr, "## Job '%s'\n", jobName)
+			}
+			fmt.Fprintln(os.Stderr, "[ERROR]", err)
+			if code := errorExitCode(err); exitCode == exitOK {
+				exitCode = code
+			}
+			continue
+		}
+
+		if jobName == "" {
+			fmt.Printf("Config file '%s' is valid\n", configFilePath)
+		} else {
+			fmt.Printf("Job '%s' is valid\n", jobName)
+		}
+	}
+
+	return exitCode
+}
+
+// selectJobs returns the names of the jobs to run: the comma separated
+// 'jobs' or all jobs of the config file. A config file without 'jobs'
+// list has a single job without name.
+func selectJobs(configFilePath string, jobs string) ([]string, error) {
+	jobNames, err := ftp_op.JobNames(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if jobs != "" {
+		jobNames = nil
+		for _, jobName := range strings.Split(jobs, ",") {
+			jobNames = append(jobNames, strings.TrimSpace(jobName))
+		}
+	}
+	if len(jobNames) == 0 {
+		jobNames = []string{""}
+	}
+	return jobNames, nil
+}
+
+// runJob runs a command for a single job. Only 'run' and 'sync'
+// connect to the remote server.
+func runJob(context *ftp_op.ServerContext, command string, reportDestinationFilePath string) int {
+	logger := jobLogger(context, command)
 
 	// Connect
-	fmt.Printf("# Connect to remote server...\n")
-	context.Connect()
+	var err error
+	if command == commandRun || command == commandSync {
+		logger.Info("Connect to remote server")
+		err = context.Connect()
+	} else {
+		err = context.Open()
+	}
+	if err != nil {
+		return fail(logger, err)
+	}
 	defer context.Disconnect()
 
+	return runSteps(logger, context, command, reportDestinationFilePath)
+}
+
+// jobLogger returns the logger of the CLI messages about a job
+func jobLogger(context *ftp_op.ServerContext, command string) *slog.Logger {
+	jobLogger := logger.With("command", command)
+	if context.JobName != "" {
+		jobLogger = jobLogger.With("job", context.JobName)
+	}
+	return jobLogger
+}
+
+// downloadProgress logs the progress of the long downloads
+func downloadProgress(logger *slog.Logger) func(progress ftp_op.Progress) {
+	return func(progress ftp_op.Progress) {
+		percent := 100.0
+		if progress.Size > 0 {
+			percent = float64(progress.Bytes) * 100 / float64(progress.Size)
+		}
+		logger.Info("Downloading file", "action", "download", "path", progress.Path,
+			"bytes", progress.Bytes, "size", progress.Size, "percent", fmt.Sprintf("%.1f", percent),
+			"duration", progress.Elapsed)
+	}
+}
+
+// runSteps runs the steps of a command on an opened or connected job
+func runSteps(logger *slog.Logger, context *ftp_op.ServerContext, command string, reportDestinationFilePath string) int {
+	start := time.Now()
+
 	// Sync remote and local dir
-	fmt.Printf("# Sync remote and local dir...\n")
-	context.Sync()
+	if command == commandRun || command == commandSync || command == commandDaemon {
+		logger.Info("Sync remote and local dir")
+		if err := context.Sync(); err != nil {
+			return fail(logger, err)
+		}
+	}
 
 	// Compress
-	fmt.Printf("\n# Compress...\n")
-	context.Compress()
+	if command == commandRun || command == commandCompress || command == commandDaemon {
+		logger.Info("Compress")
+		if err := context.Compress(); err != nil {
+			return fail(logger, err)
+		}
+	}
 
 	// Create report
-	fmt.Printf("\n# Generate compress report...\n")
-	context.CompressCreateReport(reportDestinationFilePath)
+	if command == commandRun || command == commandReport || command == commandDaemon {
+		logger.Info("Generate compress report", "path", reportDestinationFilePath)
+		if err := context.CompressCreateReport(reportDestinationFilePath); err != nil {
+			return fail(logger, err)
+		}
+	}
+
+	// Print status
+	if command == commandStatus {
+		status, err := context.Status()
+		if err != nil {
+			return fail(logger, err)
+		}
+		printStatus(context.JobName, status)
+	}
+
+	logger.Info("Done", "duration", time.Since(start))
+	return exitOK
+}
+
+// printStatus prints the status of a job to stdout
+func printStatus(jobName string, status *ftp_op.Status) {
+	if jobName != "" {
+		fmt.Printf("## Job '%s'\n", jobName)
+	}
+	fmt.Printf("Synced files:      %d (%d bytes)\n", status.Files, status.Bytes)
+	fmt.Printf("Last download:     %s\n", formatTime(status.LastDownload))
+	fmt.Printf("Last upload:       %s\n", formatTime(status.LastUpload))
+	fmt.Printf("Partial downloads: %d\n", status.PartialDownloads)
+	fmt.Printf("Compressed files:  %d\n", status.Compressed)
+	fmt.Printf("Last compression:  %s\n", formatTime(status.LastCompressed))
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// parseArgs parses the flags and returns the positional arguments. The
+// flags can be set before and after the command and the paths, the
+// parsing stops at each positional argument, and for good after '--'.
+func parseArgs(flags *flag.FlagSet, arguments []string) ([]string, error) {
+	var args []string
+	for {
+		if err := flags.Parse(arguments); err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			return args, nil
+		}
+		// 'Parse' drops the '--' before the positional arguments
+		if parsed := len(arguments) - flags.NArg(); parsed > 0 && arguments[parsed-1] == "--" {
+			return append(args, flags.Args()...), nil
+		}
+		args = append(args, flags.Arg(0))
+		arguments = flags.Args()[1:]
+	}
+}
+
+// jobReportFilePath returns the report path of a job, like
+// 'report.daily.csv' for the job 'daily' and 'report.csv'
+func jobReportFilePath(reportDestinationFilePath string, jobName string) string {
+	if jobName == "" {
+		return reportDestinationFilePath
+	}
+	extension := filepath.Ext(reportDestinationFilePath)
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(reportDestinationFilePath, extension), jobName, extension)
+}
+
+// fail logs the error and returns the exit code for its kind
+func fail(logger *slog.Logger, err error) int {
+	exitCode := errorExitCode(err)
+	logger.Error("Failed", "error", err, "exitCode", exitCode)
+	return exitCode
+}
+
+// errorExitCode returns the exit code for the kind of the error
+func errorExitCode(err error) int {
+	switch {
+	case errors.Is(err, ftp_op.ErrConfig):
+		return exitConfig
+	case errors.Is(err, ftp_op.ErrConnection):
+		return exitConnection
+	case errors.Is(err, ftp_op.ErrList):
+		return exitList
+	case errors.Is(err, ftp_op.ErrDownload):
+		return exitDownload
+	case errors.Is(err, ftp_op.ErrDeleteGuard):
+		return exitDeleteGuard
+	case errors.Is(err, ftp_op.ErrDelete):
+		return exitDelete
+	case errors.Is(err, ftp_op.ErrCompress):
+		return exitCompress
+	case errors.Is(err, ftp_op.ErrReport):
+		return exitReport
+	case errors.Is(err, ftp_op.ErrUpload):
+		return exitUpload
+	}
+	return exitUnknown
 }
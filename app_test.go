@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		arguments   string
+		wantArgs    []string
+		wantConfig  string
+		wantVerbose bool
+		wantErr     bool
+	}{
+		{name: "no argument"},
+		{name: "positional paths", arguments: "server.yml report.csv", wantArgs: []string{"server.yml", "report.csv"}},
+		{name: "flags before the command", arguments: "-v -config server.yml run", wantArgs: []string{"run"}, wantConfig: "server.yml", wantVerbose: true},
+		{name: "flags after the command", arguments: "run -config server.yml -v", wantArgs: []string{"run"}, wantConfig: "server.yml", wantVerbose: true},
+		{name: "flags between the paths", arguments: "run server.yml -v report.csv", wantArgs: []string{"run", "server.yml", "report.csv"}, wantVerbose: true},
+		{name: "paths after --", arguments: "run -- -server.yml -report.csv", wantArgs: []string{"run", "-server.yml", "-report.csv"}},
+		{name: "no flag after --", arguments: "-config server.yml -- run -v", wantArgs: []string{"run", "-v"}, wantConfig: "server.yml"},
+		{name: "flags before --", arguments: "run -v -- -report.csv", wantArgs: []string{"run", "-report.csv"}, wantVerbose: true},
+		{name: "-- after a positional argument", arguments: "run -- -v", wantArgs: []string{"run", "-v"}},
+		{name: "only --", arguments: "--"},
+		{name: "-- after --", arguments: "-- -- run", wantArgs: []string{"--", "run"}},
+		{name: "unknown flag", arguments: "run -unknown", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			flags := flag.NewFlagSet("ftpdatasync", flag.ContinueOnError)
+			flags.SetOutput(io.Discard)
+			configFilePath := flags.String("config", "", "")
+			verbose := flags.Bool("v", false, "")
+
+			args, err := parseArgs(flags, strings.Fields(test.arguments))
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("got %v, want an error", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(args, " ") != strings.Join(test.wantArgs, " ") {
+				t.Errorf("args: got %q, want %q", args, test.wantArgs)
+			}
+			if *configFilePath != test.wantConfig {
+				t.Errorf("-config: got %q, want %q", *configFilePath, test.wantConfig)
+			}
+			if *verbose != test.wantVerbose {
+				t.Errorf("-v: got %v, want %v", *verbose, test.wantVerbose)
+			}
+		})
+	}
+}
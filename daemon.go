@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	ftp_op "github.com/thenets/ftp-datasync/ftp-op"
+)
+
+// daemon runs every job on its 'schedule' or 'interval' until SIGINT or
+// SIGTERM. Each job keeps its connection and state database open between
+// its runs, and a run never starts before the previous run of the same
+// job is done.
+func daemon(contexts []*ftp_op.ServerContext, reportDestinationFilePath string, metrics *ftp_op.Metrics, metricsAddr string, metricsTextfile string) int {
+	// Stop at start if the config of any job is invalid
+	for _, context := range contexts {
+		if err := context.Open(); err != nil {
+			return fail(jobLogger(context, commandDaemon), err)
+		}
+		defer context.Disconnect()
+		if _, err := context.NextRun(time.Now()); err != nil {
+			return fail(jobLogger(context, commandDaemon), err)
+		}
+	}
+
+	// Metrics endpoint
+	if metricsAddr != "" {
+		listener, err := net.Listen("tcp", metricsAddr)
+		if err != nil {
+			logger.Error("Can't serve the metrics", "address", metricsAddr, "error", err)
+			return exitUsage
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		go http.Serve(listener, mux)
+		logger.Info("Serving metrics", "address", listener.Addr().String())
+	}
+
+	// Let the running jobs finish when stopped. The default handler is
+	// restored after the first signal, so a second one stops at once.
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		received := <-signals
+		signal.Stop(signals)
+		logger.Info("Stopping after the running jobs. Send the signal again to stop now", "signal", received.String())
+		close(done)
+	}()
+
+	var wg sync.WaitGroup
+	for _, context := range contexts {
+		wg.Add(1)
+		go func(context *ftp_op.ServerContext) {
+			defer wg.Done()
+			scheduleJob(context, done, jobReportFilePath(reportDestinationFilePath, context.JobName), metrics, metricsTextfile)
+		}(context)
+	}
+	wg.Wait()
+
+	return exitOK
+}
+
+// scheduleJob runs a job on its schedule until 'done' is closed. A
+// scheduled time is skipped if the previous run is still in progress.
+func scheduleJob(context *ftp_op.ServerContext, done <-chan struct{}, reportDestinationFilePath string, metrics *ftp_op.Metrics, metricsTextfile string) {
+	logger := jobLogger(context, commandDaemon)
+
+	for {
+		nextRun, _ := context.NextRun(time.Now())
+		logger.Info("Next run", "at", nextRun)
+		timer := time.NewTimer(time.Until(nextRun))
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// Reconnect if the connection was dropped since the last run
+		if err := context.CheckConnection(); err != nil {
+			fail(logger, err)
+		} else {
+			runSteps(logger, context, commandDaemon, reportDestinationFilePath)
+		}
+
+		if metricsTextfile != "" {
+			if err := metrics.WriteTextfile(metricsTextfile); err != nil {
+				logger.Error("Can't write the metrics", "path", metricsTextfile, "error", err)
+			}
+		}
+
+		if skippedRun, _ := context.NextRun(nextRun); skippedRun.Before(time.Now()) {
+			logger.Warn("The run took longer than the schedule, skipping the missed runs")
+		}
+	}
+}
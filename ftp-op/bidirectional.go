@@ -0,0 +1,289 @@
+package ftpop
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// Conflict policies accepted by the 'conflictPolicy' config key
+const (
+	conflictPolicySkip   = "skip"
+	conflictPolicyLocal  = "local"
+	conflictPolicyRemote = "remote"
+	conflictPolicyNewer  = "newer"
+)
+
+// States of the remote side of a directory walked by 'planBidirectional'
+const (
+	// remoteDirFound is listed and compared with the local directory
+	remoteDirFound = iota
+	// remoteDirDeleted was deleted since the last sync, the local files
+	// that didn't change since then are deleted too
+	remoteDirDeleted
+	// remoteDirNew is created by the sync, all local files are uploaded
+	remoteDirNew
+)
+
+// planBidirectional walks the local and remote directories together and
+// plans the changes that make both equal. The state database tells which
+// side changed since the last sync: changes are copied to the other side,
+// deletions are applied to the other side, and files changed on both
+// sides are conflicts solved by 'conflictPolicy'.
+// 'remoteState' tells if 'remoteDir' is listed, or doesn't exist because
+// it was deleted ('remoteDirDeleted') or is created by the sync.
+func (context *ServerContext) planBidirectional(localDir string, remoteDir string, remoteState int, plan *syncPlan) error {
+	localEntries, err := context.readLocalDir(localDir)
+	if err != nil {
+		return newError(ErrList, "planBidirectional", localDir, err)
+	}
+	remoteEntries, err := context.readRemoteDir(remoteDir, remoteState == remoteDirFound)
+	if err != nil {
+		return newError(ErrList, "planBidirectional", remoteDir, err)
+	}
+
+	// Names found on any side
+	names := []string{}
+	for _, localEntry := range localEntries {
+		names = append(names, localEntry.Name())
+	}
+	for _, remoteEntry := range remoteEntries {
+		if findLocalEntry(localEntries, remoteEntry.Name) == nil {
+			names = append(names, remoteEntry.Name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		localEntry := findLocalEntry(localEntries, name)
+		remoteEntry := findRemoteEntry(remoteEntries, name)
+		localEntryPath := fmt.Sprintf("%s/%s", localDir, name)
+		remoteEntryPath := fmt.Sprintf("%s/%s", remoteDir, name)
+		entryRelativePath := relativePath(context.syncLocalDir, localEntryPath)
+		isDir := (localEntry != nil && localEntry.IsDir()) || (remoteEntry != nil && remoteEntry.IsDir)
+
+		// Skip excluded entries
+		if isDir && !context.filter.matchDir(entryRelativePath) {
+			context.logger().Debug("Dir excluded", "action", actionSkip, "path", localEntryPath)
+			continue
+		}
+		if !isDir && !context.filter.matchFile(entryRelativePath) {
+			context.logger().Debug("File excluded", "action", actionSkip, "path", localEntryPath)
+			context.metrics().addFiles(actionSkip, 1)
+			continue
+		}
+
+		// A file can't replace a directory
+		if localEntry != nil && remoteEntry != nil && localEntry.IsDir() != remoteEntry.IsDir {
+			context.logger().Warn("Conflict: file on one side and directory on the other", "action", actionSkip, "path", entryRelativePath)
+			plan.conflicts++
+			continue
+		}
+
+		if isDir {
+			if err := context.planBidirectionalDir(localEntry, localEntryPath, remoteEntry, remoteEntryPath, remoteState, plan); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if remoteEntry != nil {
+			plan.remoteFiles++
+		}
+		if err := context.planBidirectionalFile(localEntry, localEntryPath, remoteEntry, remoteEntryPath, remoteState != remoteDirNew, plan); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// planBidirectionalDir plans the changes of a directory found on one or
+// both sides. The state database tells if a directory found on one side
+// only was synced before, and then deleted on the other side, or is new.
+func (context *ServerContext) planBidirectionalDir(localInfo os.FileInfo, localDir string, remoteEntry *RemoteEntry, remoteDir string, parentRemoteState int, plan *syncPlan) error {
+	synced := false
+	if parentRemoteState != remoteDirNew && (localInfo == nil || remoteEntry == nil) {
+		var err error
+		synced, err = context.state.hasFilesIn(relativePath(context.syncLocalDir, localDir))
+		if err != nil {
+			return newError(ErrList, "planBidirectionalDir", context.stateFilePath, err)
+		}
+	}
+
+	switch {
+	case localInfo != nil && remoteEntry != nil:
+		return context.planBidirectional(localDir, remoteDir, remoteDirFound, plan)
+
+	case localInfo != nil && synced:
+		// Deleted on remote, the local dir is removed unless some files
+		// are new or changed locally
+		dirPlan := &syncPlan{}
+		if err := context.planBidirectional(localDir, remoteDir, remoteDirDeleted, dirPlan); err != nil {
+			return err
+		}
+		if len(dirPlan.uploads) == 0 {
+			files, err := context.countLocalFiles(localDir)
+			if err != nil {
+				return newError(ErrList, "planBidirectionalDir", localDir, err)
+			}
+			if context.DryRun {
+				context.logger().Info("Dir not found on remote. Would remove it", "action", actionDelete, "path", localDir)
+			}
+			plan.deletions = append(plan.deletions, &localDeletion{localPath: localDir, isDir: true, files: files})
+			return nil
+		}
+		context.planRemoteDir(remoteDir, plan)
+		plan.merge(dirPlan)
+
+	case localInfo != nil:
+		// New locally
+		context.planRemoteDir(remoteDir, plan)
+		return context.planBidirectional(localDir, remoteDir, remoteDirNew, plan)
+
+	case synced:
+		// Deleted locally, the remote dir is removed unless some files
+		// are new or changed on remote
+		dirPlan := &syncPlan{}
+		if err := context.planBidirectional(localDir, remoteDir, remoteDirFound, dirPlan); err != nil {
+			return err
+		}
+		if len(dirPlan.downloads) == 0 {
+			files := 0
+			for _, deletion := range dirPlan.remoteDeletions {
+				files += deletion.files
+			}
+			if context.DryRun {
+				context.logger().Info("Dir not found on local. Would remove it", "action", actionDelete, "path", remoteDir)
+			}
+			plan.remoteDeletions = append(plan.remoteDeletions, &remoteDeletion{remotePath: remoteDir, isDir: true, files: files})
+			plan.remoteFiles += dirPlan.remoteFiles
+			return nil
+		}
+		plan.merge(dirPlan)
+
+	default:
+		// New on remote
+		return context.planBidirectional(localDir, remoteDir, remoteDirFound, plan)
+	}
+
+	return nil
+}
+
+// planRemoteDir plans the creation of a remote directory
+func (context *ServerContext) planRemoteDir(remoteDir string, plan *syncPlan) {
+	if context.DryRun {
+		context.logger().Info("Would create remote dir", "action", actionMakeDir, "path", remoteDir)
+	}
+	plan.remoteDirs = append(plan.remoteDirs, remoteDir)
+}
+
+// planBidirectionalFile plans the change of a file found on one or both
+// sides. 'remoteExists' is false if the remote directory wasn't listed.
+func (context *ServerContext) planBidirectionalFile(localInfo os.FileInfo, localFilePath string, remoteEntry *RemoteEntry, remoteFilePath string, remoteExists bool, plan *syncPlan) error {
+	relativeFilePath := relativePath(context.syncLocalDir, localFilePath)
+	record, err := context.state.getFile(relativeFilePath)
+	if err != nil {
+		return newError(ErrList, "planBidirectionalFile", context.stateFilePath, err)
+	}
+
+	// Changes since the last sync, everything is new without a record
+	localChanged := localInfo != nil && (record == nil ||
+		uint64(localInfo.Size()) != record.Size ||
+		!localInfo.ModTime().Equal(record.LocalTime))
+	remoteChanged := remoteEntry != nil && (record == nil ||
+		remoteEntry.Size != record.Size ||
+		!context.modTimeIsEqual(remoteEntry.Time, record.Time))
+
+	upload := func() {
+		if context.DryRun {
+			context.logger().Info("Would upload file", "action", actionUpload, "path", remoteFilePath, "bytes", localInfo.Size())
+		}
+		plan.uploads = append(plan.uploads, &uploadJob{
+			localFilePath:  localFilePath,
+			localInfo:      localInfo,
+			remoteFilePath: remoteFilePath,
+		})
+	}
+	download := func() {
+		if context.DryRun {
+			context.logger().Info("Would download file", "action", actionDownload, "path", localFilePath, "bytes", remoteEntry.Size)
+		}
+		plan.downloads = append(plan.downloads, &downloadJob{
+			remoteEntry:              remoteEntry,
+			remoteFilePath:           remoteFilePath,
+			destinationLocalFilePath: localFilePath,
+		})
+	}
+
+	switch {
+	case localInfo != nil && remoteEntry != nil:
+		// Same file on both sides, like after a sync without state
+		if record == nil && remoteEntry.Size == uint64(localInfo.Size()) &&
+			context.modTimeIsEqual(remoteEntry.Time, localInfo.ModTime()) {
+			localChanged, remoteChanged = false, false
+		}
+
+		switch {
+		case localChanged && remoteChanged:
+			context.planConflict(localInfo, localFilePath, remoteEntry, plan, upload, download)
+		case localChanged:
+			upload()
+		case remoteChanged:
+			download()
+		default:
+			context.logger().Debug("File already exist", "action", actionSkip, "path", localFilePath)
+			context.metrics().addFiles(actionSkip, 1)
+		}
+
+	case localInfo != nil:
+		// Deleted on remote unless it's new or changed locally, or the
+		// remote directory doesn't exist
+		if localChanged || !remoteExists {
+			upload()
+			break
+		}
+		if context.DryRun {
+			context.logger().Info("File not found on remote. Would remove it", "action", actionDelete, "path", localFilePath)
+		}
+		plan.deletions = append(plan.deletions, &localDeletion{localPath: localFilePath, files: 1})
+
+	case remoteEntry != nil:
+		// Deleted locally unless it's new or changed on remote
+		if remoteChanged {
+			download()
+			break
+		}
+		if context.DryRun {
+			context.logger().Info("File not found on local. Would remove it", "action", actionDelete, "path", remoteFilePath)
+		}
+		plan.remoteDeletions = append(plan.remoteDeletions, &remoteDeletion{remotePath: remoteFilePath, files: 1})
+	}
+
+	return nil
+}
+
+// planConflict plans the change of a file changed on both sides since
+// the last sync using 'conflictPolicy'
+func (context *ServerContext) planConflict(localInfo os.FileInfo, localFilePath string, remoteEntry *RemoteEntry, plan *syncPlan, upload func(), download func()) {
+	plan.conflicts++
+
+	switch context.conflictPolicy {
+	case conflictPolicyLocal:
+		context.logger().Warn("Conflict: changed on both sides. Keeping the local file", "action", actionUpload, "path", localFilePath)
+		upload()
+	case conflictPolicyRemote:
+		context.logger().Warn("Conflict: changed on both sides. Keeping the remote file", "action", actionDownload, "path", localFilePath)
+		download()
+	case conflictPolicyNewer:
+		if localInfo.ModTime().After(remoteEntry.Time) {
+			context.logger().Warn("Conflict: changed on both sides. Keeping the newer local file", "action", actionUpload, "path", localFilePath)
+			upload()
+		} else {
+			context.logger().Warn("Conflict: changed on both sides. Keeping the newer remote file", "action", actionDownload, "path", localFilePath)
+			download()
+		}
+	default:
+		context.logger().Warn("Conflict: changed on both sides", "action", actionSkip, "path", localFilePath)
+	}
+}
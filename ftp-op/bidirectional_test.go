@@ -0,0 +1,418 @@
+package ftpop
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRemote is an in-memory 'RemoteSource'. Directories are the entries
+// without content.
+type fakeRemote struct {
+	entries map[string]*fakeRemoteEntry
+	// statErr is returned by every 'Stat' call if set
+	statErr error
+}
+
+type fakeRemoteEntry struct {
+	isDir   bool
+	content []byte
+	time    time.Time
+}
+
+func newFakeRemote(dirs ...string) *fakeRemote {
+	remote := &fakeRemote{entries: map[string]*fakeRemoteEntry{}}
+	for _, dir := range dirs {
+		remote.MakeDir(dir)
+	}
+	return remote
+}
+
+func (remote *fakeRemote) writeFile(remotePath string, content string) {
+	remote.entries[remotePath] = &fakeRemoteEntry{content: []byte(content), time: time.Now().Truncate(time.Second)}
+}
+
+func (remote *fakeRemote) List(remotePath string) ([]*RemoteEntry, error) {
+	if entry, ok := remote.entries[remotePath]; !ok || !entry.isDir {
+		return nil, fmt.Errorf("'%s' %w", remotePath, os.ErrNotExist)
+	}
+	entries := []*RemoteEntry{}
+	for entryPath := range remote.entries {
+		if path.Dir(entryPath) == remotePath && entryPath != remotePath {
+			entry, _ := remote.Stat(entryPath)
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func (remote *fakeRemote) Retrieve(remotePath string, offset uint64) (io.ReadCloser, error) {
+	entry, ok := remote.entries[remotePath]
+	if !ok || entry.isDir {
+		return nil, fmt.Errorf("'%s' %w", remotePath, os.ErrNotExist)
+	}
+	return io.NopCloser(bytes.NewReader(entry.content[offset:])), nil
+}
+
+func (remote *fakeRemote) Stat(remotePath string) (*RemoteEntry, error) {
+	if remote.statErr != nil {
+		return nil, remote.statErr
+	}
+	entry, ok := remote.entries[remotePath]
+	if !ok {
+		return nil, fmt.Errorf("'%s' %w", remotePath, os.ErrNotExist)
+	}
+	return &RemoteEntry{
+		Name:  path.Base(remotePath),
+		IsDir: entry.isDir,
+		Size:  uint64(len(entry.content)),
+		Time:  entry.time,
+	}, nil
+}
+
+func (remote *fakeRemote) Store(remotePath string, r io.Reader) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	remote.writeFile(remotePath, string(content))
+	return nil
+}
+
+func (remote *fakeRemote) Rename(from string, to string) error {
+	remote.entries[to] = remote.entries[from]
+	delete(remote.entries, from)
+	return nil
+}
+
+func (remote *fakeRemote) MakeDir(remotePath string) error {
+	remote.entries[remotePath] = &fakeRemoteEntry{isDir: true}
+	return nil
+}
+
+func (remote *fakeRemote) Remove(remotePath string) error {
+	delete(remote.entries, remotePath)
+	return nil
+}
+
+func (remote *fakeRemote) RemoveDir(remotePath string) error {
+	for entryPath := range remote.entries {
+		if entryPath == remotePath || strings.HasPrefix(entryPath, remotePath+"/") {
+			delete(remote.entries, entryPath)
+		}
+	}
+	return nil
+}
+
+func (remote *fakeRemote) Close() error {
+	return nil
+}
+
+// files returns the remote file paths relative to 'rootDir'
+func (remote *fakeRemote) files(rootDir string) []string {
+	files := []string{}
+	for entryPath, entry := range remote.entries {
+		if !entry.isDir && strings.HasPrefix(entryPath, rootDir+"/") {
+			files = append(files, relativePath(rootDir, entryPath))
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// newBidirectionalContext returns a context syncing a temporary local
+// directory with '/data' of 'remote', with an open state database
+func newBidirectionalContext(t *testing.T, remote *fakeRemote) *ServerContext {
+	t.Helper()
+	filter, err := newPathFilter(nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := &ServerContext{
+		Logger:            slog.New(slog.NewTextHandler(io.Discard, nil)),
+		syncRemoteDir:     "/data",
+		syncLocalDir:      filepath.ToSlash(filepath.Join(t.TempDir(), "mirror")),
+		filter:            filter,
+		direction:         directionBidirectional,
+		conflictPolicy:    conflictPolicySkip,
+		parallelDownloads: 1,
+		resumeDownloads:   true,
+		retryMaxAttempts:  1,
+		verifyMode:        verifyModeSize,
+		stateFilePath:     filepath.Join(t.TempDir(), "state.db"),
+		remote:            remote,
+	}
+	if err := context.openState(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { context.closeState() })
+	return context
+}
+
+// writeLocalFile creates a file inside the local directory of 'context'
+func writeLocalFile(t *testing.T, context *ServerContext, relativeFilePath string, content string) {
+	t.Helper()
+	localPath := filepath.Join(context.syncLocalDir, filepath.FromSlash(relativeFilePath))
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(localPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// localFiles returns the local file paths relative to the local directory
+func localFiles(t *testing.T, context *ServerContext) []string {
+	t.Helper()
+	files := []string{}
+	err := filepath.Walk(context.syncLocalDir, func(localPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			relativeFilePath, err := context.localRelativePath(localPath)
+			if err != nil {
+				return err
+			}
+			files = append(files, relativeFilePath)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func TestPlanBidirectionalFile(t *testing.T) {
+	const (
+		unchanged = "unchanged"
+		changed   = "changed"
+		added     = "added"
+	)
+
+	tests := []struct {
+		name string
+		// local and remote are the changes of each side since the
+		// last sync, empty if the file doesn't exist on that side
+		local  string
+		remote string
+		// remoteExists is false if the remote dir wasn't listed
+		remoteExists   bool
+		conflictPolicy string
+		want           string
+	}{
+		{name: "unchanged", local: unchanged, remote: unchanged, remoteExists: true, want: "skip"},
+		{name: "changed locally", local: changed, remote: unchanged, remoteExists: true, want: "upload"},
+		{name: "changed on remote", local: unchanged, remote: changed, remoteExists: true, want: "download"},
+		{name: "new locally", local: added, remoteExists: true, want: "upload"},
+		{name: "new on remote", remote: added, remoteExists: true, want: "download"},
+		{name: "deleted on remote", local: unchanged, remoteExists: true, want: "delete"},
+		{name: "deleted on remote but changed locally", local: changed, remoteExists: true, want: "upload"},
+		{name: "deleted locally", remote: unchanged, remoteExists: true, want: "remote delete"},
+		{name: "deleted locally but changed on remote", remote: changed, remoteExists: true, want: "download"},
+		{name: "remote dir not listed", local: unchanged, remoteExists: false, want: "upload"},
+		{name: "conflict skipped", local: changed, remote: changed, remoteExists: true, conflictPolicy: conflictPolicySkip, want: "conflict"},
+		{name: "conflict kept local", local: changed, remote: changed, remoteExists: true, conflictPolicy: conflictPolicyLocal, want: "upload"},
+		{name: "conflict kept remote", local: changed, remote: changed, remoteExists: true, conflictPolicy: conflictPolicyRemote, want: "download"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remote := newFakeRemote("/data")
+			context := newBidirectionalContext(t, remote)
+			if test.conflictPolicy != "" {
+				context.conflictPolicy = test.conflictPolicy
+			}
+			localFilePath := context.syncLocalDir + "/file.txt"
+			remoteFilePath := "/data/file.txt"
+			syncedTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+			// Record the last sync of 'synced', unless the file is new
+			if test.local != added && test.remote != added {
+				err := context.state.put(stateBucketFiles, "file.txt", &fileState{
+					Size: 6, Time: syncedTime, LocalTime: syncedTime,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var localInfo os.FileInfo
+			if test.local != "" {
+				content, modTime := "synced", syncedTime
+				if test.local != unchanged {
+					content, modTime = "local change", syncedTime.Add(time.Minute)
+				}
+				writeLocalFile(t, context, "file.txt", content)
+				if err := os.Chtimes(localFilePath, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+				var err error
+				if localInfo, err = os.Stat(localFilePath); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var remoteEntry *RemoteEntry
+			if test.remote != "" {
+				remoteEntry = &RemoteEntry{Name: "file.txt", Size: 6, Time: syncedTime}
+				if test.remote != unchanged {
+					remoteEntry.Size, remoteEntry.Time = 13, syncedTime.Add(2*time.Minute)
+				}
+			}
+
+			plan := &syncPlan{}
+			err := context.planBidirectionalFile(localInfo, localFilePath, remoteEntry, remoteFilePath, test.remoteExists, plan)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := "skip"
+			switch {
+			case len(plan.uploads) == 1:
+				got = "upload"
+			case len(plan.downloads) == 1:
+				got = "download"
+			case len(plan.deletions) == 1:
+				got = "delete"
+			case len(plan.remoteDeletions) == 1:
+				got = "remote delete"
+			case plan.conflicts == 1:
+				got = "conflict"
+			}
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPlanBidirectional(t *testing.T) {
+	tests := []struct {
+		name string
+		// change is applied after a first sync of 'a/1.txt', 'a/2.txt'
+		// and 'b/3.txt'
+		change     func(t *testing.T, context *ServerContext, remote *fakeRemote)
+		wantErr    error
+		wantLocal  []string
+		wantRemote []string
+	}{
+		{
+			name:       "nothing changed",
+			change:     func(t *testing.T, context *ServerContext, remote *fakeRemote) {},
+			wantLocal:  []string{"a/1.txt", "a/2.txt", "b/3.txt"},
+			wantRemote: []string{"a/1.txt", "a/2.txt", "b/3.txt"},
+		},
+		{
+			name: "remote root stat fails",
+			change: func(t *testing.T, context *ServerContext, remote *fakeRemote) {
+				remote.statErr = errors.New("timeout")
+			},
+			wantErr:    ErrList,
+			wantLocal:  []string{"a/1.txt", "a/2.txt", "b/3.txt"},
+			wantRemote: []string{"a/1.txt", "a/2.txt", "b/3.txt"},
+		},
+		{
+			name: "remote root deleted",
+			change: func(t *testing.T, context *ServerContext, remote *fakeRemote) {
+				remote.RemoveDir("/data")
+			},
+			wantLocal:  []string{"a/1.txt", "a/2.txt", "b/3.txt"},
+			wantRemote: []string{"a/1.txt", "a/2.txt", "b/3.txt"},
+		},
+		{
+			name: "dir deleted on remote",
+			change: func(t *testing.T, context *ServerContext, remote *fakeRemote) {
+				remote.RemoveDir("/data/a")
+			},
+			wantLocal:  []string{"b/3.txt"},
+			wantRemote: []string{"b/3.txt"},
+		},
+		{
+			name: "dir deleted on remote with a new local file",
+			change: func(t *testing.T, context *ServerContext, remote *fakeRemote) {
+				remote.RemoveDir("/data/a")
+				writeLocalFile(t, context, "a/new.txt", "new")
+			},
+			wantLocal:  []string{"a/new.txt", "b/3.txt"},
+			wantRemote: []string{"a/new.txt", "b/3.txt"},
+		},
+		{
+			name: "dir deleted locally",
+			change: func(t *testing.T, context *ServerContext, remote *fakeRemote) {
+				os.RemoveAll(filepath.Join(context.syncLocalDir, "a"))
+			},
+			wantLocal:  []string{"b/3.txt"},
+			wantRemote: []string{"b/3.txt"},
+		},
+		{
+			name: "dir deleted locally with a new remote file",
+			change: func(t *testing.T, context *ServerContext, remote *fakeRemote) {
+				os.RemoveAll(filepath.Join(context.syncLocalDir, "a"))
+				remote.writeFile("/data/a/new.txt", "new")
+			},
+			wantLocal:  []string{"a/new.txt", "b/3.txt"},
+			wantRemote: []string{"a/new.txt", "b/3.txt"},
+		},
+		{
+			name: "new dirs on both sides",
+			change: func(t *testing.T, context *ServerContext, remote *fakeRemote) {
+				writeLocalFile(t, context, "c/4.txt", "4")
+				remote.MakeDir("/data/d")
+				remote.writeFile("/data/d/5.txt", "5")
+			},
+			wantLocal:  []string{"a/1.txt", "a/2.txt", "b/3.txt", "c/4.txt", "d/5.txt"},
+			wantRemote: []string{"a/1.txt", "a/2.txt", "b/3.txt", "c/4.txt", "d/5.txt"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remote := newFakeRemote("/data", "/data/a")
+			remote.writeFile("/data/a/1.txt", "1")
+			remote.writeFile("/data/a/2.txt", "2")
+			context := newBidirectionalContext(t, remote)
+			writeLocalFile(t, context, "b/3.txt", "3")
+			if err := context.Sync(); err != nil {
+				t.Fatalf("first sync: %v", err)
+			}
+
+			test.change(t, context, remote)
+			err := context.Sync()
+			if test.wantErr == nil && err != nil {
+				t.Fatalf("second sync: %v", err)
+			}
+			if test.wantErr != nil && !errors.Is(err, test.wantErr) {
+				t.Fatalf("got error %v, want %v", err, test.wantErr)
+			}
+
+			// The state of the first sync must be kept after an error
+			remote.statErr = nil
+			if got := localFiles(t, context); strings.Join(got, ",") != strings.Join(test.wantLocal, ",") {
+				t.Errorf("local files: got %v, want %v", got, test.wantLocal)
+			}
+			if got := remote.files("/data"); strings.Join(got, ",") != strings.Join(test.wantRemote, ",") {
+				t.Errorf("remote files: got %v, want %v", got, test.wantRemote)
+			}
+			for _, dir := range []string{"/data/a", "/data/b"} {
+				_, remoteErr := remote.Stat(dir)
+				_, localErr := os.Stat(filepath.Join(context.syncLocalDir, relativePath("/data", dir)))
+				if (remoteErr == nil) != (localErr == nil) {
+					t.Errorf("dir '%s' exists on one side only", dir)
+				}
+			}
+		})
+	}
+}
@@ -2,36 +2,123 @@ package ftpop
 
 import (
 	"archive/zip"
+	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/blake2b"
 )
 
-func (context *ServerContext) Compress() {
+// Compress compresses every file of the local sync directory into the
+// compress directory and removes compressed files without origin.
+func (context *ServerContext) Compress() error {
+	start := time.Now()
+	err := context.compress()
+	context.metrics().observeRun(operationCompress, start, err)
+	return err
+}
+
+func (context *ServerContext) compress() error {
+	// The connection is idle while compressing
+	defer context.keepAlive()()
+
 	// Get all files from 'originDir', compress it, and
 	// save them in 'targetDir'
 	originDir, err := filepath.Abs(context.syncLocalDir)
-	check(err, "[Compress] can't resolve absolute path from 'originDir'")
+	if err != nil {
+		return newError(ErrCompress, "Compress", context.syncLocalDir, err)
+	}
 	targetDir, err := filepath.Abs(context.compressDir)
-	check(err, "[Compress] can't resolve absolute path from 'targetDir'")
+	if err != nil {
+		return newError(ErrCompress, "Compress", context.compressDir, err)
+	}
+	if context.state == nil && !context.DryRun {
+		return newError(ErrCompress, "Compress", originDir, errors.New("not opened"))
+	}
+	if err := context.startTrashRun(); err != nil {
+		return newError(ErrDelete, "Compress", context.trashDir, err)
+	}
+
+	if context.DryRun {
+		// Nothing to compress if 'originDir' wasn't synced yet
+		if _, err := os.Stat(originDir); os.IsNotExist(err) {
+			return nil
+		}
+		// Nothing to delete if 'targetDir' doesn't exist yet
+		if _, err := os.Stat(targetDir); os.IsNotExist(err) {
+			return context.compressFilesRecursive(originDir, targetDir)
+		}
+	} else if err := ensureDirExist(targetDir); err != nil {
+		return newError(ErrCompress, "Compress", targetDir, err)
+	}
+
+	if err := context.compressFilesRecursive(originDir, targetDir); err != nil {
+		return err
+	}
+
+	// Find compressed files without origin before deleting anything
+	var deletions []*localDeletion
+	if err := context.deleteObsoleteCompressedFiles(originDir, targetDir, &deletions); err != nil {
+		return err
+	}
+
+	// Abort if too many compressed files would be deleted
+	deletedFiles := 0
+	for _, deletion := range deletions {
+		deletedFiles += deletion.files
+	}
+	countCompressedFiles := func() (int, error) {
+		return countFiles(targetDir, func(path string, info os.FileInfo) bool {
+			return strings.HasSuffix(info.Name(), ".zip")
+		})
+	}
+	if err := context.checkDeleteGuard("Compress", targetDir, deletedFiles, countCompressedFiles); err != nil {
+		return err
+	}
+
+	if !context.DryRun {
+		for _, deletion := range deletions {
+			// The hash file of a compressed file may not exist
+			if !fileExists(deletion.localPath) {
+				continue
+			}
+			context.logger().Info("File not found on origin. Removing its compressed file", "action", actionDelete, "path", deletion.localPath)
+			err := context.removeLocal(trashAreaCompress, deletion.localPath)
+			if err != nil && !os.IsNotExist(err) {
+				return newError(ErrDelete, "Compress", deletion.localPath, err)
+			}
+			context.metrics().addFiles(actionDelete, deletion.files)
+		}
+	}
+
+	// Forget the compressed files that were removed
+	if !context.DryRun {
+		if err := context.state.prune(stateBucketCompressed, targetDir, ".zip"); err != nil {
+			return newError(ErrDelete, "Compress", context.stateFilePath, err)
+		}
+	}
 
-	compressFilesRecursive(originDir, targetDir)
-	deleteObsoleteCompressedFiles(originDir, targetDir)
-	deleteEmptyDirs(targetDir)
+	return context.deleteEmptyDirs(targetDir)
 }
 
-func compressFilesRecursive(originDir string, targetDir string) {
+func (context *ServerContext) compressFilesRecursive(originDir string, targetDir string) error {
 	// Get list of 'originEntries' in 'originDir'
 	originEntries, err := ioutil.ReadDir(originDir)
-	check(err, "[compressFilesRecursive] Can't read 'originDir' path")
+	if err != nil {
+		return newError(ErrCompress, "compressFilesRecursive", originDir, err)
+	}
 
 	// For each entry in 'originDir'
 	for _, originEntry := range originEntries {
@@ -39,143 +126,210 @@ func compressFilesRecursive(originDir string, targetDir string) {
 			// Recursive call if is a sub-directory
 			originEntrySubPath := fmt.Sprintf("%s/%s", originDir, originEntry.Name())
 			targetEntrySubPath := fmt.Sprintf("%s/%s", targetDir, originEntry.Name())
-			compressFilesRecursive(originEntrySubPath, targetEntrySubPath)
+			if err := context.compressFilesRecursive(originEntrySubPath, targetEntrySubPath); err != nil {
+				return err
+			}
+		} else if context.isPartialDownload(fmt.Sprintf("%s/%s", originDir, originEntry.Name())) {
+			// Skip partial downloads
+			continue
 		} else {
 			// Compress if is a file
-			originFilePath, err := filepath.Abs(fmt.Sprintf("%s/%s", originDir, originEntry.Name()))
-			check(err, "[compressFilesRecursive] can't resolve absolute path from 'originFilePath'")
-			targetFilePath, err := filepath.Abs(fmt.Sprintf("%s/%s.zip", targetDir, originEntry.Name()))
-			check(err, "[compressFilesRecursive] can't resolve absolute path from 'targetFilePath'")
-			hashFilePath, err := filepath.Abs(fmt.Sprintf("%s/%s.hash", targetDir, originEntry.Name()))
-			check(err, "[compressFilesRecursive] can't resolve absolute path from 'hashFilePath'")
-
-			ensureDirExist(targetDir)
-			compressFile(originFilePath, targetFilePath, hashFilePath)
+			// ('originDir' and 'targetDir' are already absolute paths)
+			originFilePath := fmt.Sprintf("%s/%s", originDir, originEntry.Name())
+			targetFilePath := fmt.Sprintf("%s/%s.zip", targetDir, originEntry.Name())
+			relativeFilePath, err := context.localRelativePath(originFilePath)
+			if err != nil {
+				return newError(ErrCompress, "compressFilesRecursive", originFilePath, err)
+			}
+
+			if !context.DryRun {
+				if err := ensureDirExist(targetDir); err != nil {
+					return newError(ErrCompress, "compressFilesRecursive", targetDir, err)
+				}
+			}
+			err = context.compressFile(originFilePath, targetFilePath, relativeFilePath)
+			if err = context.handleError(err); err != nil {
+				return err
+			}
 		}
 	}
+
+	return nil
 }
 
-func compressFile(originFilePath string, compressedFilePath string, hashFilePath string) {
-	needToCompress := false
+func (context *ServerContext) compressFile(originFilePath string, compressedFilePath string, relativeFilePath string) error {
+	// Hashes of the last compression
+	record, err := context.state.getCompressed(relativeFilePath)
+	if err != nil {
+		return newError(ErrCompress, "compressFile", context.stateFilePath, err)
+	}
 
-	// Check if hash file exist
-	fileInfo, err := os.Stat(hashFilePath)
-	if os.IsNotExist(err) {
-		needToCompress = true
-	} else {
-		if fileInfo.IsDir() {
-			os.RemoveAll(hashFilePath)
-			needToCompress = true
+	// Import the hash file written next to the zip file by older versions
+	hashFilePath := strings.TrimSuffix(compressedFilePath, ".zip") + ".hash"
+	hashFileExists := checkLocalFileExists(hashFilePath)
+	if record == nil && hashFileExists {
+		lastOriginalFileHash, lastCompressedFileHash, err := openHashFile(hashFilePath)
+		if err != nil {
+			return newError(ErrCompress, "compressFile", hashFilePath, err)
+		}
+		if lastOriginalFileHash != "" {
+			record = &compressState{Hash: lastOriginalFileHash, CompressedHash: lastCompressedFileHash}
 		}
 	}
 
-	// Check hash file
-	currentOriginalFileHash := getHashFromFile(originFilePath, "sha1")
-	currentCompressedFileHash := getHashFromFile(compressedFilePath, "sha1")
-	lastOriginalFileHash, lastCompressedFileHash := openHashFile(hashFilePath)
-	if currentOriginalFileHash != lastOriginalFileHash {
-		// Need to recompress if both hashes are not equal
-		needToCompress = true
+	// Check hashes
+	currentOriginalFileHash, err := getHashFromFile(originFilePath, "sha1")
+	if err != nil {
+		return newError(ErrCompress, "compressFile", originFilePath, err)
+	}
+	currentCompressedFileHash, err := getHashFromFile(compressedFilePath, "sha1")
+	if err != nil {
+		return newError(ErrCompress, "compressFile", compressedFilePath, err)
 	}
-	if currentCompressedFileHash != lastCompressedFileHash {
-		// Need to recompress if both hashes are not equal
-		needToCompress = true
+	// Need to recompress if the original or the compressed file changed
+	needToCompress := record == nil ||
+		currentOriginalFileHash != record.Hash ||
+		currentCompressedFileHash != record.CompressedHash
+
+	// Only print the plan in dry-run mode
+	if context.DryRun {
+		if needToCompress {
+			context.logger().Info("Would compress file", "action", actionCompress, "path", compressedFilePath)
+		} else {
+			context.logger().Debug("File already compressed", "action", actionSkip, "path", compressedFilePath)
+			context.metrics().addFiles(actionSkip, 1)
+		}
+		return nil
 	}
 
 	// Compress only if needed
 	if needToCompress {
-		fmt.Println("Compressing:", compressedFilePath)
+		start := time.Now()
+		context.logger().Debug("Compressing file", "action", actionCompress, "path", compressedFilePath)
 		files := []string{originFilePath}
 		if err := zipFiles(compressedFilePath, files); err != nil {
-			panic(err)
+			return newError(ErrCompress, "compressFile", compressedFilePath, err)
 		}
 
+		newCompressedFileHash, err := getHashFromFile(compressedFilePath, "sha1")
+		if err != nil {
+			return newError(ErrCompress, "compressFile", compressedFilePath, err)
+		}
+		record = &compressState{
+			Hash:           currentOriginalFileHash,
+			CompressedHash: newCompressedFileHash,
+			CompressedAt:   time.Now(),
+		}
+		duration := time.Since(start)
+		originInfo, err := os.Stat(originFilePath)
+		if err != nil {
+			return newError(ErrCompress, "compressFile", originFilePath, err)
+		}
+		context.logger().Info("Compressed file", "action", actionCompress, "path", compressedFilePath,
+			"bytes", originInfo.Size(), "duration", duration)
+		context.metrics().observeFile(actionCompress, uint64(originInfo.Size()), duration)
 	} else {
-		fmt.Println("Skipping compress:", hashFilePath)
+		context.logger().Debug("File already compressed", "action", actionSkip, "path", compressedFilePath)
+		context.metrics().addFiles(actionSkip, 1)
 	}
 
-	// Create new hash file
-	newCompressedFileHash := getHashFromFile(compressedFilePath, "sha1")
-	writeHashFile(hashFilePath, currentOriginalFileHash, newCompressedFileHash)
+	// Save the hashes
+	if needToCompress || hashFileExists {
+		if err := context.state.put(stateBucketCompressed, relativeFilePath, record); err != nil {
+			return newError(ErrCompress, "compressFile", context.stateFilePath, err)
+		}
+	}
+	if hashFileExists {
+		if err := os.Remove(hashFilePath); err != nil {
+			return newError(ErrCompress, "compressFile", hashFilePath, err)
+		}
+	}
 
+	return nil
 }
 
 // openHashFile returns the 'originalFileHash' and 'compressedFileHash'
-// from a valid hash file.
+// from a valid hash file written by older versions.
 // Valid hash file format example:
 // 62cdd0166772aa8de3b0c0ec60331d5249525ffa;b066df618ba28c33df2bcebfa9c879ea6632cbc6
-func openHashFile(hashFilePath string) (string, string) {
+func openHashFile(hashFilePath string) (string, string, error) {
 	// Check if is a valid hash file format
 	_, err := os.Stat(hashFilePath)
 	if os.IsNotExist(err) {
-		return "", ""
+		return "", "", nil
 	}
 
 	dat, err := ioutil.ReadFile(hashFilePath)
-	check(err, "[openHashFile] Can't open hash file")
+	if err != nil {
+		return "", "", err
+	}
 
 	hashList := strings.Split(string(dat), ";")
 
 	// Check if is a valid hash file format
 	if len(hashList) != 2 {
-		return "", ""
+		return "", "", nil
 	}
 
 	originalFileHash := hashList[0]
 	compressedFileHash := hashList[1]
 
-	return originalFileHash, compressedFileHash
-}
-
-func writeHashFile(hashFilePath string, originalFileHash string, compressedFileHash string) {
-	f, err := os.Create(hashFilePath)
-	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
-
-	f.WriteString(
-		fmt.Sprintf("%s;%s", originalFileHash, compressedFileHash),
-	)
+	return originalFileHash, compressedFileHash, nil
 }
 
 // getHashFromFile returns the hash content of a file in string format
-// hashAlgorithm options: [black2b, sha1]
-func getHashFromFile(filePath string, hashAlgorithm string) string {
+// hashAlgorithm options: [black2b, sha1, sha256, md5, crc32]
+func getHashFromFile(filePath string, hashAlgorithm string) (string, error) {
 	var hashString string
-	var err error
 
 	if !fileExists(filePath) {
-		return ""
+		return "", nil
 	}
 
 	if hashAlgorithm == "blake2b" {
 		content, err := ioutil.ReadFile(filePath)
-		check(err, "[getHashFromFile] Fail trying to hash using 'blake2b'")
+		if err != nil {
+			return "", err
+		}
 		hash := blake2b.Sum256(content)
 		hashString = hex.EncodeToString(hash[:])
-	} else if hashAlgorithm == "sha1" {
+	} else {
+		hash, err := newHash(hashAlgorithm)
+		if err != nil {
+			return "", err
+		}
 		hashString, err = func(filePath string) (string, error) {
-			var returnSHA1String string
 			file, err := os.Open(filePath)
 			if err != nil {
-				return returnSHA1String, err
+				return "", err
 			}
 			defer file.Close()
-			hash := sha1.New()
 			if _, err := io.Copy(hash, file); err != nil {
-				return returnSHA1String, err
+				return "", err
 			}
-			hashInBytes := hash.Sum(nil)[:20]
-			returnSHA1String = hex.EncodeToString(hashInBytes)
-			return returnSHA1String, nil
+			return hex.EncodeToString(hash.Sum(nil)), nil
 		}(filePath)
-		check(err, "[getHashFromFile] Fail trying to hash using 'sha1'")
-	} else {
-		log.Fatalln("hashAlgorithm not supported!")
+		if err != nil {
+			return "", err
+		}
 	}
 
-	return hashString
+	return hashString, nil
+}
+
+// newHash returns a streaming hash for the 'hashAlgorithm' name
+func newHash(hashAlgorithm string) (hash.Hash, error) {
+	switch hashAlgorithm {
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "md5":
+		return md5.New(), nil
+	case "crc32":
+		return crc32.NewIEEE(), nil
+	}
+	return nil, fmt.Errorf("hashAlgorithm '%s' not supported", hashAlgorithm)
 }
 
 // zipFiles compresses one or many files into a single zip archive file.
@@ -190,15 +344,18 @@ func zipFiles(filename string, files []string) error {
 	defer newZipFile.Close()
 
 	zipWriter := zip.NewWriter(newZipFile)
-	defer zipWriter.Close()
 
 	// Add files to zip
 	for _, file := range files {
 		if err = addFileToZip(zipWriter, file); err != nil {
+			zipWriter.Close()
 			return err
 		}
 	}
-	return nil
+	if err = zipWriter.Close(); err != nil {
+		return err
+	}
+	return newZipFile.Close()
 }
 
 func addFileToZip(zipWriter *zip.Writer, filename string) error {
@@ -237,32 +394,40 @@ func addFileToZip(zipWriter *zip.Writer, filename string) error {
 	return err
 }
 
-// deleteObsoleteCompressedFiles deletes all compressed files that doesn't exist in 'originDir' directory
-func deleteObsoleteCompressedFiles(originDir string, compressDir string) {
+// deleteObsoleteCompressedFiles plans the deletion of all compressed files that doesn't exist in 'originDir' directory
+func (context *ServerContext) deleteObsoleteCompressedFiles(originDir string, compressDir string, deletions *[]*localDeletion) error {
 	// Get list of 'compressEntries' in 'compressDir'
 	compressEntries, err := ioutil.ReadDir(compressDir)
 	if err != nil {
-		check(err, "[deleteObsoleteCompressedFiles] can't read 'compressDir' dir")
+		return newError(ErrDelete, "deleteObsoleteCompressedFiles", compressDir, err)
 	}
 
 	// Check if exist in origin
 	for _, compressEntry := range compressEntries { // for each compressEntry
 		if compressEntry.IsDir() {
 			// Recursive call if is a dir
-			deleteObsoleteCompressedFiles(
+			err := context.deleteObsoleteCompressedFiles(
 				fmt.Sprintf("%s/%s", originDir, compressEntry.Name()),
 				fmt.Sprintf("%s/%s", compressDir, compressEntry.Name()),
+				deletions,
 			)
+			if err != nil {
+				return err
+			}
 			continue
 		}
 
-		// Check if is a hash file
+		// Check if is a hash file left by older versions
 		if strings.HasSuffix(compressEntry.Name(), ".hash") {
 			// Check if exist origin file relative to hash
 			// delete it if do not
 			fileNameWithoutHashExtension := compressEntry.Name()[:len(compressEntry.Name())-5]
 			if !fileExists(compressDir + "/" + fileNameWithoutHashExtension + ".zip") {
-				os.Remove(compressDir + "/" + compressEntry.Name())
+				hashFilePath := compressDir + "/" + compressEntry.Name()
+				if context.DryRun {
+					context.logger().Info("Would remove hash file", "action", actionDelete, "path", hashFilePath)
+				}
+				*deletions = append(*deletions, &localDeletion{localPath: hashFilePath})
 			}
 
 			// Else ignore hash file
@@ -276,91 +441,108 @@ func deleteObsoleteCompressedFiles(originDir string, compressDir string) {
 
 		// Delete 'compressEntry' and hash file if not found in origin
 		if !fileFoundInOrigin {
-			fmt.Printf("File '%s' not found on origin. Removing...\n", originFilePath)
-
 			compressEntryPath := compressDir + "/" + fileNameWithoutZipExtension
-			os.Remove(compressEntryPath + ".zip")
-			os.Remove(compressEntryPath + ".hash")
+			if context.DryRun {
+				context.logger().Info("File not found on origin. Would remove its compressed file", "action", actionDelete, "path", compressEntryPath+".zip")
+			}
+			*deletions = append(*deletions,
+				&localDeletion{localPath: compressEntryPath + ".zip", files: 1},
+				&localDeletion{localPath: compressEntryPath + ".hash"},
+			)
 		} else {
 			// fmt.Println("File found!", originFilePath)
 		}
 
 	}
+
+	return nil
 }
 
 // deleteEmptyDirs delete all subdirs if is empty
-func deleteEmptyDirs(targetDir string) {
+func (context *ServerContext) deleteEmptyDirs(targetDir string) error {
 
 	// Recursive call all other subdirs
 	entries, err := ioutil.ReadDir(targetDir)
 	if err != nil {
-		check(err, "[deleteEmptyDirs] can't read 'targetDir' dir")
+		return newError(ErrDelete, "deleteEmptyDirs", targetDir, err)
 	}
 	for _, entry := range entries {
 		if entry.IsDir() {
-			deleteEmptyDirs(targetDir + "/" + entry.Name())
+			if err := context.deleteEmptyDirs(targetDir + "/" + entry.Name()); err != nil {
+				return err
+			}
 		}
 	}
 
 	// Delete dir if empty
 	entries, err = ioutil.ReadDir(targetDir)
 	if err != nil {
-		check(err, "[deleteEmptyDirs] can't read 'targetDir' dir")
+		return newError(ErrDelete, "deleteEmptyDirs", targetDir, err)
 	}
 	if len(entries) == 0 {
-		os.RemoveAll(targetDir)
+		if context.DryRun {
+			context.logger().Info("Would remove empty dir", "action", actionDelete, "path", targetDir)
+			return nil
+		}
+		if err := os.RemoveAll(targetDir); err != nil {
+			return newError(ErrDelete, "deleteEmptyDirs", targetDir, err)
+		}
 	}
+
+	return nil
 }
 
-func (context *ServerContext) CompressCreateReport(reportFilePath string) {
+// CompressCreateReport writes a CSV report with the hashes of every
+// compressed file to 'reportFilePath'.
+func (context *ServerContext) CompressCreateReport(reportFilePath string) error {
+	if context.DryRun {
+		context.logger().Info("Would write report", "path", reportFilePath)
+		return nil
+	}
+	if context.state == nil {
+		return newError(ErrReport, "CompressCreateReport", reportFilePath, errors.New("not opened"))
+	}
+
+	f, err := os.OpenFile(reportFilePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return newError(ErrReport, "CompressCreateReport", reportFilePath, err)
+	}
+
 	// Create report header
-	header := []byte("originalFileHash,compressedFileHash,compressedFilePath\n")
-	err := ioutil.WriteFile(reportFilePath, header, 0644)
+	_, err = f.WriteString("originalFileHash,compressedFileHash,compressedFilePath\n")
+	if err == nil {
+		err = context.compressReport(f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		panic(err)
+		return newError(ErrReport, "CompressCreateReport", reportFilePath, err)
 	}
 
-	// Scan dir
-	compressReportScanDir(
-		context.compressDir,
-		reportFilePath,
-	)
+	return nil
 }
 
-func compressReportScanDir(targetDir string, reportFilePath string) {
-	entries, err := ioutil.ReadDir(targetDir)
+// compressReport writes a report line for each compressed file recorded
+// in the state database
+func (context *ServerContext) compressReport(report io.Writer) error {
+	absoluteCompressDir, err := filepath.Abs(context.compressDir)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	for _, entry := range entries {
-		// If is a dir
-		if entry.IsDir() {
-			compressReportScanDir(
-				targetDir+"/"+entry.Name(),
-				reportFilePath,
-			)
-			continue
+	return context.state.forEach(stateBucketCompressed, func(relativeFilePath string, data []byte) error {
+		record := &compressState{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return err
 		}
 
-		// If is a .hash file
-		if strings.HasSuffix(entry.Name(), ".hash") {
-			// Create line to write
-			fileNameWithoutHashExtension := entry.Name()[:len(entry.Name())-5]
-			absoluteCompressedFilePath, _ := filepath.Abs(targetDir + "/" + fileNameWithoutHashExtension + ".zip")
-			originalFileHash, compressedFileHash := openHashFile(targetDir + "/" + entry.Name())
-			line := fmt.Sprintf("%s,%s,%s\n", originalFileHash, compressedFileHash, absoluteCompressedFilePath)
+		// Create line to write
+		absoluteCompressedFilePath := filepath.Join(absoluteCompressDir, filepath.FromSlash(relativeFilePath)+".zip")
+		line := fmt.Sprintf("%s,%s,%s\n", record.Hash, record.CompressedHash, absoluteCompressedFilePath)
 
-			// Write in report file
-			f, err := os.OpenFile(reportFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-			if err != nil {
-				log.Println(err)
-			}
-			defer f.Close()
-			if _, err := f.WriteString(line); err != nil {
-				log.Println(err)
-			}
-		}
-
-	}
+		// Write in report file
+		_, err := io.WriteString(report, line)
+		return err
+	})
 }
@@ -0,0 +1,88 @@
+package ftpop
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// envPrefix is the prefix of the environment variables overriding the
+// keys of the config file, like 'FTPDATASYNC_HOSTPASSWORD'.
+const envPrefix = "FTPDATASYNC"
+
+// envReference matches the '${NAME}' references in config values
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the '${NAME}' references in the string values of
+// 'value' by the value of the environment variable 'NAME'. A reference
+// to an unset variable is an error.
+func expandEnv(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case string:
+		var err error
+		expanded := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+			name := envReference.FindStringSubmatch(reference)[1]
+			envValue, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable '%s' is not set", name)
+			}
+			return envValue
+		})
+		return expanded, err
+
+	case map[string]interface{}:
+		for key, item := range value {
+			expanded, err := expandEnv(item)
+			if err != nil {
+				return nil, err
+			}
+			value[key] = expanded
+		}
+		return value, nil
+
+	case []interface{}:
+		for i, item := range value {
+			expanded, err := expandEnv(item)
+			if err != nil {
+				return nil, err
+			}
+			value[i] = expanded
+		}
+		return value, nil
+	}
+	return value, nil
+}
+
+// bindEnv lets the 'FTPDATASYNC_<KEY>' environment variables override
+// every key of the config
+func bindEnv(config *viper.Viper) {
+	config.SetEnvPrefix(envPrefix)
+	config.AutomaticEnv()
+}
+
+// configSecret returns the value of the key 'key' or the content of the
+// file set in the key '<key>File', like the secrets mounted by Docker
+// and Kubernetes. Returns 'false' if none of them is set.
+func configSecret(config *viper.Viper, key string) (string, bool, error) {
+	secretFilePath := config.GetString(key + "File")
+	if secretFilePath == "" {
+		if config.Get(key) == nil {
+			return "", false, nil
+		}
+		return config.GetString(key), true, nil
+	}
+	if config.Get(key) != nil {
+		return "", false, fmt.Errorf("'%s' and '%sFile' can't be both set", key, key)
+	}
+
+	content, err := ioutil.ReadFile(secretFilePath)
+	if err != nil {
+		return "", false, fmt.Errorf("can't read '%sFile': %v", key, err)
+	}
+	// Files usually end with a line break
+	return strings.TrimRight(string(content), "\r\n"), true, nil
+}
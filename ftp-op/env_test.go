@@ -0,0 +1,216 @@
+package ftpop
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// unsetEnv unsets the environment variable 'name' for the test
+func unsetEnv(t *testing.T, name string) {
+	t.Setenv(name, "")
+	os.Unsetenv(name)
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("FTPDATASYNC_TEST_USER", "alice")
+	t.Setenv("FTPDATASYNC_TEST_EMPTY", "")
+	unsetEnv(t, "FTPDATASYNC_TEST_UNSET")
+
+	tests := []struct {
+		name    string
+		value   interface{}
+		want    interface{}
+		wantErr bool
+	}{
+		{name: "reference", value: "${FTPDATASYNC_TEST_USER}", want: "alice"},
+		{name: "inside a string", value: "/home/${FTPDATASYNC_TEST_USER}/data", want: "/home/alice/data"},
+		{name: "several references", value: "${FTPDATASYNC_TEST_USER}:${FTPDATASYNC_TEST_USER}", want: "alice:alice"},
+		{name: "empty variable", value: "a${FTPDATASYNC_TEST_EMPTY}b", want: "ab"},
+		{name: "not a reference", value: "$FTPDATASYNC_TEST_USER ${} ${1A}", want: "$FTPDATASYNC_TEST_USER ${} ${1A}"},
+		{name: "unset variable", value: "${FTPDATASYNC_TEST_UNSET}", wantErr: true},
+		{name: "unset variable after a set one", value: "${FTPDATASYNC_TEST_USER}${FTPDATASYNC_TEST_UNSET}", wantErr: true},
+		{name: "not a string", value: 21, want: 21},
+		{
+			name: "nested values",
+			value: map[string]interface{}{
+				"hostUser": "${FTPDATASYNC_TEST_USER}",
+				"include":  []interface{}{"${FTPDATASYNC_TEST_USER}/*.csv", true},
+				"jobs":     map[string]interface{}{"a": map[string]interface{}{"hostUser": "${FTPDATASYNC_TEST_USER}"}},
+			},
+			want: map[string]interface{}{
+				"hostUser": "alice",
+				"include":  []interface{}{"alice/*.csv", true},
+				"jobs":     map[string]interface{}{"a": map[string]interface{}{"hostUser": "alice"}},
+			},
+		},
+		{
+			name:    "nested unset variable",
+			value:   map[string]interface{}{"include": []interface{}{"${FTPDATASYNC_TEST_UNSET}"}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := expandEnv(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConfigEnvOverride(t *testing.T) {
+	dir := t.TempDir()
+	configFilePath := filepath.Join(dir, "server.yml")
+	config := "hostUser: ${FTPDATASYNC_TEST_USER}\nhostPassword: ${FTPDATASYNC_TEST_PASSWORD}\n"
+	if err := os.WriteFile(configFilePath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantUser     string
+		wantPassword string
+		wantErr      bool
+	}{
+		{
+			name:         "references",
+			env:          map[string]string{"FTPDATASYNC_TEST_USER": "alice", "FTPDATASYNC_TEST_PASSWORD": "secret"},
+			wantUser:     "alice",
+			wantPassword: "secret",
+		},
+		{
+			name: "override",
+			env: map[string]string{
+				"FTPDATASYNC_TEST_USER":     "alice",
+				"FTPDATASYNC_TEST_PASSWORD": "secret",
+				"FTPDATASYNC_HOSTPASSWORD":  "override",
+			},
+			wantUser:     "alice",
+			wantPassword: "override",
+		},
+		{
+			// The references are expanded when loading the file, even
+			// if the key is overridden
+			name:    "override of a key with an unset reference",
+			env:     map[string]string{"FTPDATASYNC_TEST_USER": "alice", "FTPDATASYNC_HOSTPASSWORD": "override"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, name := range []string{"FTPDATASYNC_TEST_USER", "FTPDATASYNC_TEST_PASSWORD", "FTPDATASYNC_HOSTPASSWORD"} {
+				unsetEnv(t, name)
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			config, err := loadConfigFile(configFilePath)
+			if test.wantErr {
+				if err == nil {
+					t.Error("got nil, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			bindEnv(config)
+
+			if got := config.GetString("hostUser"); got != test.wantUser {
+				t.Errorf("hostUser: got %q, want %q", got, test.wantUser)
+			}
+			password, found, err := configSecret(config, "hostPassword")
+			if err != nil || !found || password != test.wantPassword {
+				t.Errorf("hostPassword: got %q, %v, %v, want %q", password, found, err, test.wantPassword)
+			}
+		})
+	}
+}
+
+func TestConfigSecret(t *testing.T) {
+	secretFilePath := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(secretFilePath, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	unsetEnv(t, "FTPDATASYNC_HOSTPASSWORD")
+	unsetEnv(t, "FTPDATASYNC_HOSTPASSWORDFILE")
+
+	tests := []struct {
+		name      string
+		values    map[string]interface{}
+		env       map[string]string
+		want      string
+		wantFound bool
+		wantErr   bool
+	}{
+		{name: "not set"},
+		{name: "value", values: map[string]interface{}{"hostPassword": "secret"}, want: "secret", wantFound: true},
+		{name: "empty value", values: map[string]interface{}{"hostPassword": ""}, want: "", wantFound: true},
+		{name: "file", values: map[string]interface{}{"hostPasswordFile": secretFilePath}, want: "from-file", wantFound: true},
+		{name: "value and file", values: map[string]interface{}{"hostPassword": "secret", "hostPasswordFile": secretFilePath}, wantErr: true},
+		{name: "missing file", values: map[string]interface{}{"hostPasswordFile": secretFilePath + ".missing"}, wantErr: true},
+		{
+			name:      "value overridden by the environment",
+			values:    map[string]interface{}{"hostPassword": "secret"},
+			env:       map[string]string{"FTPDATASYNC_HOSTPASSWORD": "from-env"},
+			want:      "from-env",
+			wantFound: true,
+		},
+		{
+			name:      "file set by the environment",
+			env:       map[string]string{"FTPDATASYNC_HOSTPASSWORDFILE": secretFilePath},
+			want:      "from-file",
+			wantFound: true,
+		},
+		{
+			// Setting the other key in the environment doesn't unset
+			// the one of the config file
+			name:    "file of the config and value of the environment",
+			values:  map[string]interface{}{"hostPasswordFile": secretFilePath},
+			env:     map[string]string{"FTPDATASYNC_HOSTPASSWORD": "from-env"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			config := viper.New()
+			if err := config.MergeConfigMap(test.values); err != nil {
+				t.Fatal(err)
+			}
+			bindEnv(config)
+
+			got, found, err := configSecret(config, "hostPassword")
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("got %q, want an error", got)
+				}
+				return
+			}
+			if err != nil || got != test.want || found != test.wantFound {
+				t.Errorf("got %q, %v, %v, want %q, %v", got, found, err, test.want, test.wantFound)
+			}
+		})
+	}
+}
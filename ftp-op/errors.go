@@ -0,0 +1,69 @@
+package ftpop
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds returned by ServerContext methods. Use errors.Is to check
+// which stage of the pipeline failed.
+// Example:
+//
+//	if errors.Is(err, ftpop.ErrDownload) { ... }
+var (
+	ErrConfig     = errors.New("config error")
+	ErrConnection = errors.New("connection error")
+	ErrList       = errors.New("listing error")
+	ErrDownload   = errors.New("download error")
+	ErrUpload     = errors.New("upload error")
+	ErrDelete     = errors.New("deletion error")
+	// ErrDeleteGuard is returned when a run would delete more files
+	// than the mass deletion guard allows
+	ErrDeleteGuard = errors.New("mass deletion guard")
+	ErrCompress    = errors.New("compression error")
+	ErrReport      = errors.New("report error")
+)
+
+// Error describes a failure of a single operation, the path it was
+// working on and the error kind it belongs to.
+type Error struct {
+	Kind error
+	Op   string
+	Path string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("[%s] %s: %v", e.Op, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("[%s] %s '%s': %v", e.Op, e.Kind, e.Path, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether 'target' is the kind of this error.
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+func newError(kind error, op string, path string, err error) *Error {
+	return &Error{Kind: kind, Op: op, Path: path, Err: err}
+}
+
+// handleError gives 'ErrorHandler' the chance to skip a failure of a
+// single file. Returns the error that must abort the current operation
+// or nil if it can continue.
+func (context *ServerContext) handleError(err error) error {
+	if err == nil {
+		return nil
+	}
+	context.metrics().countError(err)
+	if context.ErrorHandler == nil {
+		return err
+	}
+	return context.ErrorHandler(err)
+}
@@ -0,0 +1,133 @@
+package ftpop
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// pathFilter decides which remote paths are synchronized, using the
+// 'include' and 'exclude' lists of the config file. Paths are relative
+// to 'syncRemoteDir' and always use '/' as separator.
+type pathFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// newPathFilter compiles the glob patterns and regular expressions.
+// Glob patterns support '*', '?', '[...]' and '**' to match any number
+// of directories. A glob pattern without '/' matches the file name
+// in any directory.
+func newPathFilter(includeGlobs, excludeGlobs, includeRegexps, excludeRegexps []string) (*pathFilter, error) {
+	filter := &pathFilter{}
+
+	for _, pattern := range includeGlobs {
+		re, err := globToRegexp(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'include' pattern '%s': %v", pattern, err)
+		}
+		filter.include = append(filter.include, re)
+	}
+	for _, pattern := range excludeGlobs {
+		re, err := globToRegexp(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'exclude' pattern '%s': %v", pattern, err)
+		}
+		filter.exclude = append(filter.exclude, re)
+	}
+	for _, pattern := range includeRegexps {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'includeRegex' pattern '%s': %v", pattern, err)
+		}
+		filter.include = append(filter.include, re)
+	}
+	for _, pattern := range excludeRegexps {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'excludeRegex' pattern '%s': %v", pattern, err)
+		}
+		filter.exclude = append(filter.exclude, re)
+	}
+
+	return filter, nil
+}
+
+// isEmpty returns 'true' if there isn't any pattern
+func (filter *pathFilter) isEmpty() bool {
+	return len(filter.include) == 0 && len(filter.exclude) == 0
+}
+
+// matchDir returns 'true' if the directory must be walked. Only the
+// exclude patterns apply to directories, because included files can
+// be inside any directory.
+func (filter *pathFilter) matchDir(relativePath string) bool {
+	return !matchAny(filter.exclude, relativePath)
+}
+
+// matchFile returns 'true' if the file must be synchronized
+func (filter *pathFilter) matchFile(relativePath string) bool {
+	if len(filter.include) > 0 && !matchAny(filter.include, relativePath) {
+		return false
+	}
+	return !matchAny(filter.exclude, relativePath)
+}
+
+func matchAny(patterns []*regexp.Regexp, relativePath string) bool {
+	for _, re := range patterns {
+		if re.MatchString(relativePath) {
+			return true
+		}
+	}
+	return false
+}
+
+// globToRegexp converts a glob pattern to an anchored regular expression
+func globToRegexp(pattern string) (*regexp.Regexp, error) {
+	pattern = strings.Trim(path.Clean("/"+pattern), "/")
+
+	// Match the file name in any directory
+	if !strings.Contains(pattern, "/") && !strings.Contains(pattern, "**") {
+		pattern = "**/" + pattern
+	}
+
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			// Zero or more directories
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			// The directory itself and everything inside it
+			re.WriteString("(?:/.*)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ']'")
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+
+	return regexp.Compile(re.String())
+}
@@ -0,0 +1,131 @@
+package ftpop
+
+import "testing"
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		// A pattern without '/' matches the file name in any directory
+		{pattern: "*.csv", path: "a.csv", want: true},
+		{pattern: "*.csv", path: "2024/01/a.csv", want: true},
+		{pattern: "*.csv", path: "a.csv.zip", want: false},
+
+		// '*' doesn't cross '/'
+		{pattern: "logs/*.log", path: "logs/a.log", want: true},
+		{pattern: "logs/*.log", path: "logs/old/a.log", want: false},
+		{pattern: "logs/*", path: "logs/old/a.log", want: false},
+		{pattern: "/logs/*.log", path: "logs/a.log", want: true},
+
+		// '**' matches any number of directories
+		{pattern: "logs/**/*.log", path: "logs/a.log", want: true},
+		{pattern: "logs/**/*.log", path: "logs/2024/01/a.log", want: true},
+		{pattern: "logs/**/*.log", path: "other/logs/a.log", want: false},
+		{pattern: "logs/**", path: "logs", want: true},
+		{pattern: "logs/**", path: "logs/2024/a.log", want: true},
+		{pattern: "logs/**", path: "logs2/a.log", want: false},
+		{pattern: "**/tmp", path: "a/b/tmp", want: true},
+		{pattern: "**/tmp", path: "tmp", want: true},
+		{pattern: "data**", path: "data/a/b.txt", want: true},
+
+		// '?' matches one character, but not '/'
+		{pattern: "file?.txt", path: "file1.txt", want: true},
+		{pattern: "file?.txt", path: "file.txt", want: false},
+		{pattern: "file?.txt", path: "file12.txt", want: false},
+		{pattern: "a?b", path: "a/b", want: false},
+
+		// Character classes
+		{pattern: "file[0-9].txt", path: "file5.txt", want: true},
+		{pattern: "file[0-9].txt", path: "fileX.txt", want: false},
+		{pattern: "file[!0-9].txt", path: "fileX.txt", want: true},
+		{pattern: "file[!0-9].txt", path: "file5.txt", want: false},
+
+		// Regular expression characters are literal
+		{pattern: "a.txt", path: "a.txt", want: true},
+		{pattern: "a.txt", path: "abtxt", want: false},
+		{pattern: "c++.txt", path: "c++.txt", want: true},
+		{pattern: "c++.txt", path: "cc.txt", want: false},
+		{pattern: "(a)|b$", path: "(a)|b$", want: true},
+		{pattern: "(a)|b$", path: "b", want: false},
+	}
+
+	for _, test := range tests {
+		re, err := globToRegexp(test.pattern)
+		if err != nil {
+			t.Errorf("globToRegexp(%q): %v", test.pattern, err)
+			continue
+		}
+		if got := re.MatchString(test.path); got != test.want {
+			t.Errorf("globToRegexp(%q) matching %q: got %v, want %v (%s)", test.pattern, test.path, got, test.want, re)
+		}
+	}
+}
+
+func TestGlobToRegexpInvalid(t *testing.T) {
+	if _, err := globToRegexp("file[0-9.txt"); err == nil {
+		t.Error("got nil, want an error for the missing ']'")
+	}
+}
+
+func TestPathFilter(t *testing.T) {
+	tests := []struct {
+		name           string
+		include        []string
+		exclude        []string
+		includeRegexps []string
+		excludeRegexps []string
+		path           string
+		wantFile       bool
+		wantDir        bool
+	}{
+		{name: "no pattern", path: "a/b.txt", wantFile: true, wantDir: true},
+		{name: "included", include: []string{"*.csv"}, path: "a/b.csv", wantFile: true, wantDir: true},
+		{name: "not included", include: []string{"*.csv"}, path: "a/b.txt", wantFile: false, wantDir: true},
+		{name: "excluded", exclude: []string{"*.tmp"}, path: "a/b.tmp", wantFile: false, wantDir: false},
+		{name: "exclude wins over include", include: []string{"*.csv"}, exclude: []string{"tmp/**"}, path: "tmp/b.csv", wantFile: false, wantDir: false},
+		{name: "exclude wins in any order", include: []string{"tmp/**"}, exclude: []string{"*.csv"}, path: "tmp/b.csv", wantFile: false, wantDir: false},
+		{name: "included by a regexp", includeRegexps: []string{`^\d{4}/`}, path: "2024/a.txt", wantFile: true, wantDir: true},
+		{name: "excluded by a regexp", include: []string{"*.txt"}, excludeRegexps: []string{`^old/`}, path: "old/a.txt", wantFile: false, wantDir: false},
+		{name: "included by a glob or a regexp", include: []string{"*.csv"}, includeRegexps: []string{`\.txt$`}, path: "a.txt", wantFile: true, wantDir: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := newPathFilter(test.include, test.exclude, test.includeRegexps, test.excludeRegexps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := filter.matchFile(test.path); got != test.wantFile {
+				t.Errorf("matchFile: got %v, want %v", got, test.wantFile)
+			}
+			if got := filter.matchDir(test.path); got != test.wantDir {
+				t.Errorf("matchDir: got %v, want %v", got, test.wantDir)
+			}
+		})
+	}
+}
+
+func TestPathFilterInvalidPattern(t *testing.T) {
+	tests := []struct {
+		name           string
+		include        []string
+		exclude        []string
+		includeRegexps []string
+		excludeRegexps []string
+	}{
+		{name: "include", include: []string{"[a-"}},
+		{name: "exclude", exclude: []string{"[a-"}},
+		{name: "includeRegex", includeRegexps: []string{"("}},
+		{name: "excludeRegex", excludeRegexps: []string{"("}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newPathFilter(test.include, test.exclude, test.includeRegexps, test.excludeRegexps); err == nil {
+				t.Error("got nil, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package ftpop
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// checkDeleteGuard returns an error if deleting 'deletedFiles' files of
+// the 'rootDir' tree exceeds the thresholds of the config file.
+// 'countTotal' returns the number of files of the tree, the total of
+// the percentage. It protects the tree when the listing of the other
+// side suddenly comes back empty or tiny. Ignored if 'ForceDelete' is set.
+func (context *ServerContext) checkDeleteGuard(op string, rootDir string, deletedFiles int, countTotal func() (int, error)) error {
+	if deletedFiles == 0 || context.ForceDelete {
+		return nil
+	}
+	if context.deleteGuardMaxFiles <= 0 && context.deleteGuardMaxPercent <= 0 {
+		return nil
+	}
+
+	// Absolute count
+	if context.deleteGuardMaxFiles > 0 && deletedFiles > context.deleteGuardMaxFiles {
+		return newError(ErrDeleteGuard, op, rootDir, fmt.Errorf(
+			"%d files would be deleted, more than 'deleteGuardMaxFiles' (%d). Use --force-delete to delete them anyway",
+			deletedFiles, context.deleteGuardMaxFiles))
+	}
+
+	// Percentage of the tree
+	if context.deleteGuardMaxPercent > 0 {
+		totalFiles, err := countTotal()
+		if err != nil {
+			return newError(ErrList, op, rootDir, err)
+		}
+
+		percent := 100 * float64(deletedFiles) / float64(totalFiles)
+		if totalFiles > 0 && percent > context.deleteGuardMaxPercent {
+			return newError(ErrDeleteGuard, op, rootDir, fmt.Errorf(
+				"%d of %d files (%.1f%%) would be deleted, more than 'deleteGuardMaxPercent' (%.1f%%). Use --force-delete to delete them anyway",
+				deletedFiles, totalFiles, percent, context.deleteGuardMaxPercent))
+		}
+	}
+
+	return nil
+}
+
+// countLocalFiles returns the number of files inside 'localDir' that
+// 'removeLocalDir' would delete.
+func (context *ServerContext) countLocalFiles(localDir string) (int, error) {
+	return countFiles(localDir, func(path string, info os.FileInfo) bool {
+		if context.isPartialDownload(path) {
+			return false
+		}
+		return context.filter.matchFile(relativePath(context.syncLocalDir, filepath.ToSlash(path)))
+	})
+}
+
+// countFiles returns the number of files inside 'rootDir' accepted by
+// 'match'.
+func countFiles(rootDir string, match func(path string, info os.FileInfo) bool) (int, error) {
+	count := 0
+	err := filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && match(path, info) {
+			count++
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	return count, err
+}
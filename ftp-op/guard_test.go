@@ -0,0 +1,65 @@
+package ftpop
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckDeleteGuard(t *testing.T) {
+	tests := []struct {
+		name         string
+		maxFiles     int
+		maxPercent   float64
+		forceDelete  bool
+		deletedFiles int
+		totalFiles   int
+		wantErr      bool
+	}{
+		{name: "disabled", deletedFiles: 100, totalFiles: 100},
+		{name: "nothing deleted", maxFiles: 1, maxPercent: 1, deletedFiles: 0, totalFiles: 100},
+		{name: "max files reached", maxFiles: 10, deletedFiles: 10, totalFiles: 100},
+		{name: "max files exceeded", maxFiles: 10, deletedFiles: 11, totalFiles: 100, wantErr: true},
+		{name: "max files disabled", maxFiles: 0, maxPercent: 50, deletedFiles: 11, totalFiles: 100},
+		{name: "max percent reached", maxPercent: 50, deletedFiles: 50, totalFiles: 100},
+		{name: "max percent exceeded", maxPercent: 50, deletedFiles: 51, totalFiles: 100, wantErr: true},
+		{name: "max percent disabled", maxFiles: 100, maxPercent: 0, deletedFiles: 100, totalFiles: 100},
+		{name: "max percent of a fraction", maxPercent: 33.3, deletedFiles: 1, totalFiles: 3, wantErr: true},
+		{name: "both limits, files exceeded", maxFiles: 5, maxPercent: 90, deletedFiles: 6, totalFiles: 100, wantErr: true},
+		{name: "both limits, percent exceeded", maxFiles: 50, maxPercent: 10, deletedFiles: 11, totalFiles: 100, wantErr: true},
+		{name: "empty mirror", maxPercent: 50, deletedFiles: 1, totalFiles: 0},
+		{name: "forced", maxFiles: 1, maxPercent: 1, forceDelete: true, deletedFiles: 100, totalFiles: 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			context := &ServerContext{
+				ForceDelete:           test.forceDelete,
+				deleteGuardMaxFiles:   test.maxFiles,
+				deleteGuardMaxPercent: test.maxPercent,
+			}
+			countTotal := func() (int, error) {
+				return test.totalFiles, nil
+			}
+
+			err := context.checkDeleteGuard("Sync", "/mirror", test.deletedFiles, countTotal)
+			if test.wantErr && !errors.Is(err, ErrDeleteGuard) {
+				t.Errorf("got %v, want ErrDeleteGuard", err)
+			}
+			if !test.wantErr && err != nil {
+				t.Errorf("got %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestCheckDeleteGuardCountError(t *testing.T) {
+	context := &ServerContext{deleteGuardMaxPercent: 50}
+	countTotal := func() (int, error) {
+		return 0, errors.New("permission denied")
+	}
+
+	err := context.checkDeleteGuard("Sync", "/mirror", 1, countTotal)
+	if !errors.Is(err, ErrList) {
+		t.Errorf("got %v, want ErrList", err)
+	}
+}
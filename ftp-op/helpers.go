@@ -1,8 +1,6 @@
 package ftpop
 
 import (
-	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -11,40 +9,49 @@ import (
 	"github.com/spf13/viper"
 )
 
-func check(err error, errMsg string) {
-	if err != nil {
-		log.Println(errMsg)
-		panic(err)
-	}
-}
-
 func debug(e interface{}) {
 	pretty.Println(e)
 }
 
 func ensureDirExist(dirName string) error {
-	err := os.MkdirAll(dirName, os.ModeDir)
+	err := os.MkdirAll(dirName, 0755)
 	if err == nil || os.IsExist(err) {
 		return nil
 	}
 	return err
 }
 
+// syncDir flushes the entries of a directory to disk, so a
+// previous rename inside it survives a crash.
+func syncDir(dirName string) error {
+	dir, err := os.Open(dirName)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
 // fileExists checks if a file exists and is not a directory before we
 // try using it to prevent further errors.
 func fileExists(filename string) bool {
 	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
+	if err != nil {
 		return false
 	}
 	return !info.IsDir()
 }
 
-func (context *ServerContext) readConfig() {
+// loadConfigFile reads the config file into a new viper instance and
+// expands the '${NAME}' environment variable references of its values
+func loadConfigFile(configFilePath string) (*viper.Viper, error) {
 	// Split dir path and config file name
 	var configDirPath string
 	var configFileName string
-	configFilePath := strings.ReplaceAll(context.ConfigFilePath, "\\", "/")
+	configFilePath = strings.ReplaceAll(configFilePath, "\\", "/")
 	if !strings.Contains(configFilePath, "/") {
 		configDirPath = "."
 		configFileName = configFilePath
@@ -60,49 +67,217 @@ func (context *ServerContext) readConfig() {
 
 	// Resolve absolute path
 	absoluteConfigDirPath, err := filepath.Abs(configDirPath)
-	check(err, "[readConfig] can't resolve absolute path from 'configDirPath'")
+	if err != nil {
+		return nil, err
+	}
 
 	// Load config file
-	viper.AddConfigPath(absoluteConfigDirPath) // path to look for the config file in
-	viper.SetConfigName(configFileName)        // name of config file (without extension)
-	err = viper.ReadInConfig()                 // Find and read the config file
-	if err != nil {                            // Handle errors reading the config file
-		panic(fmt.Errorf("fatal error config file: %s", err))
+	config := viper.New()
+	config.AddConfigPath(absoluteConfigDirPath) // path to look for the config file in
+	config.SetConfigName(configFileName)        // name of config file (without extension)
+	err = config.ReadInConfig()                 // Find and read the config file
+	if err != nil {                             // Handle errors reading the config file
+		return nil, err
+	}
+
+	// Expand environment variables
+	settings, err := expandEnv(config.AllSettings())
+	if err != nil {
+		return nil, err
+	}
+	expandedConfig := viper.New()
+	if err := expandedConfig.MergeConfigMap(settings.(map[string]interface{})); err != nil {
+		return nil, err
+	}
+
+	return expandedConfig, nil
+}
+
+// readConfig loads the config file, or the job 'JobName' of it, into
+// the context. All the problems found are returned at once.
+func (context *ServerContext) readConfig() error {
+	configFile, err := loadConfigFile(context.ConfigFilePath)
+	if err != nil {
+		return newError(ErrConfig, "readConfig", context.ConfigFilePath, err)
+	}
+
+	// Keys of the selected job
+	config, err := jobConfig(configFile, context.JobName)
+	if err != nil {
+		return newError(ErrConfig, "readConfig", context.ConfigFilePath, err)
 	}
+	bindEnv(config)
+	reader := &configReader{config: config}
 
 	// Populate struct with connection data
-	if viper.Get("hostAddress") == nil {
-		panic("[readConfig] Variable 'hostAddress' not found in config file")
+	context.hostAddress = reader.required("hostAddress")
+	if !reader.isSet("hostPort") {
+		reader.problem("variable '%s' not found in config file", "hostPort")
+	} else if hostPort, ok := reader.integer("hostPort"); ok && (hostPort < 1 || hostPort > 65535) {
+		reader.problem("invalid 'hostPort' value %d (must be between 1 and 65535)", hostPort)
+	} else {
+		context.hostPort = hostPort
+	}
+	context.hostUser = reader.required("hostUser")
+
+	// Remote protocol (optional)
+	config.SetDefault("protocol", protocolFTP)
+	context.protocol = reader.oneOf("protocol", protocolFTP, protocolSFTP)
+
+	// SSH authentication (optional)
+	context.sshPrivateKeyFile = reader.file("sshPrivateKeyFile")
+	context.sshPrivateKeyPassphrase, _, err = configSecret(config, "sshPrivateKeyPassphrase")
+	if err != nil {
+		reader.problem("%v", err)
+	}
+	context.sshKnownHostsFile = reader.file("sshKnownHostsFile")
+	context.sshInsecureIgnoreHostKey = reader.boolean("sshInsecureIgnoreHostKey")
+
+	// The password isn't required if a SSH key is used
+	hostPassword, found, err := configSecret(config, "hostPassword")
+	if err != nil {
+		reader.problem("%v", err)
+	} else if !found && context.sshPrivateKeyFile == "" {
+		reader.problem("variable '%s' not found in config file", "hostPassword")
+	}
+	context.hostPassword = hostPassword
+
+	context.syncRemoteDir = reader.required("syncRemoteDir")
+	context.syncLocalDir = reader.required("syncLocalDir")
+	context.compressDir = reader.required("compressDir")
+	if context.syncLocalDir != "" && context.compressDir != "" &&
+		(isInsideDir(context.syncLocalDir, context.compressDir) || isInsideDir(context.compressDir, context.syncLocalDir)) {
+		reader.problem("'syncLocalDir' and 'compressDir' can't be the same dir or inside each other")
+	}
+
+	// Trash (optional)
+	context.trashDir = reader.str("trashDir")
+	if context.trashDir != "" &&
+		(isInsideDir(context.trashDir, context.syncLocalDir) || isInsideDir(context.trashDir, context.compressDir)) {
+		reader.problem("'trashDir' can't be inside 'syncLocalDir' or 'compressDir'")
+	}
+	if trashRetentionDays, ok := reader.integer("trashRetentionDays"); ok {
+		context.trashRetentionDays = trashRetentionDays
+	}
+	if context.trashRetentionDays < 0 {
+		reader.problem("invalid 'trashRetentionDays' value %d (must be 0 or more)", context.trashRetentionDays)
+	}
+
+	// Mass deletion guard (optional)
+	if deleteGuardMaxFiles, ok := reader.integer("deleteGuardMaxFiles"); ok {
+		context.deleteGuardMaxFiles = deleteGuardMaxFiles
+	}
+	if context.deleteGuardMaxFiles < 0 {
+		reader.problem("invalid 'deleteGuardMaxFiles' value %d (must be 0 or more)", context.deleteGuardMaxFiles)
+	}
+	if deleteGuardMaxPercent, ok := reader.number("deleteGuardMaxPercent"); ok {
+		context.deleteGuardMaxPercent = deleteGuardMaxPercent
+	}
+	if context.deleteGuardMaxPercent < 0 || context.deleteGuardMaxPercent > 100 {
+		reader.problem("invalid 'deleteGuardMaxPercent' value %v (must be between 0 and 100)", context.deleteGuardMaxPercent)
 	}
-	context.hostAddress = viper.GetString("hostAddress")
 
-	if viper.Get("hostPort") == nil {
-		panic("[readConfig] Variable 'hostPort' not found in config file")
+	// Include and exclude filters (optional)
+	context.filter, err = newPathFilter(
+		reader.stringSlice("include"),
+		reader.stringSlice("exclude"),
+		reader.stringSlice("includeRegex"),
+		reader.stringSlice("excludeRegex"),
+	)
+	if err != nil {
+		reader.problem("%v", err)
 	}
-	context.hostPort = viper.GetInt("hostPort")
 
-	if viper.Get("hostUser") == nil {
-		panic("[readConfig] Variable 'hostUser' not found in config file")
+	// Sync direction (optional)
+	config.SetDefault("direction", directionDownload)
+	context.direction = reader.oneOf("direction", directionDownload, directionUpload, directionBidirectional)
+	config.SetDefault("conflictPolicy", conflictPolicySkip)
+	context.conflictPolicy = reader.oneOf("conflictPolicy",
+		conflictPolicySkip, conflictPolicyLocal, conflictPolicyRemote, conflictPolicyNewer)
+
+	// Parallel downloads (optional)
+	config.SetDefault("parallelDownloads", 1)
+	if parallelDownloads, ok := reader.integer("parallelDownloads"); ok && parallelDownloads < 1 {
+		reader.problem("invalid 'parallelDownloads' value %d (must be 1 or more)", parallelDownloads)
+	} else {
+		context.parallelDownloads = parallelDownloads
 	}
-	context.hostUser = viper.GetString("hostUser")
 
-	if viper.Get("hostPassword") == nil {
-		panic("[readConfig] Variable 'hostPassword' not found in config file")
+	// Change detection (optional)
+	config.SetDefault("verifyMode", verifyModeSize)
+	context.verifyMode = reader.oneOf("verifyMode", verifyModeSize, verifyModeHash)
+	config.SetDefault("timeTolerance", "0s")
+	context.timeTolerance = reader.duration("timeTolerance")
+	config.SetDefault("useMLSD", true)
+	context.useMLSD = reader.boolean("useMLSD")
+	config.SetDefault("useMDTM", true)
+	context.useMDTM = reader.boolean("useMDTM")
+
+	// State database (optional)
+	context.stateFilePath = reader.str("stateFile")
+	if context.stateFilePath == "" && context.syncLocalDir != "" {
+		context.stateFilePath, err = defaultStateFilePath(context.syncLocalDir)
+		if err != nil {
+			reader.problem("%v", err)
+		}
+	}
+	if context.stateFilePath != "" &&
+		(isInsideDir(context.stateFilePath, context.syncLocalDir) || isInsideDir(context.stateFilePath, context.compressDir)) {
+		reader.problem("'stateFile' can't be inside 'syncLocalDir' or 'compressDir'")
 	}
-	context.hostPassword = viper.GetString("hostPassword")
 
-	if viper.Get("syncRemoteDir") == nil {
-		panic("[readConfig] Variable 'syncRemoteDir' not found in config file")
+	// Resume interrupted downloads (optional)
+	config.SetDefault("resumeDownloads", true)
+	context.resumeDownloads = reader.boolean("resumeDownloads")
+
+	// Download speed limit (optional)
+	context.downloadRateLimiter = reader.rateLimiter("downloadRateLimit", "downloadRateLimitSchedule")
+
+	// Timeouts (optional)
+	config.SetDefault("dialTimeout", "5s")
+	context.dialTimeout = reader.duration("dialTimeout")
+	config.SetDefault("readTimeout", "0s")
+	context.readTimeout = reader.duration("readTimeout")
+	config.SetDefault("dataTimeout", "0s")
+	context.dataTimeout = reader.duration("dataTimeout")
+	config.SetDefault("keepAliveInterval", "0s")
+	context.keepAliveInterval = reader.duration("keepAliveInterval")
+
+	// FTP data connection mode (optional)
+	config.SetDefault("ftpMode", ftpModeEPSV)
+	context.ftpMode = reader.oneOf("ftpMode", ftpModeEPSV, ftpModePassive, ftpModeActive)
+
+	// Retries (optional)
+	config.SetDefault("retryMaxAttempts", 3)
+	if retryMaxAttempts, ok := reader.integer("retryMaxAttempts"); ok && retryMaxAttempts < 1 {
+		reader.problem("invalid 'retryMaxAttempts' value %d (must be 1 or more)", retryMaxAttempts)
+	} else {
+		context.retryMaxAttempts = retryMaxAttempts
+	}
+	config.SetDefault("retryDelay", "1s")
+	context.retryDelay = reader.duration("retryDelay")
+	config.SetDefault("retryMaxDelay", "1m")
+	context.retryMaxDelay = reader.duration("retryMaxDelay")
+	if context.retryMaxDelay < context.retryDelay {
+		reader.problem("'retryMaxDelay' can't be shorter than 'retryDelay'")
 	}
-	context.syncRemoteDir = viper.GetString("syncRemoteDir")
 
-	if viper.Get("syncLocalDir") == nil {
-		panic("[readConfig] Variable 'syncLocalDir' not found in config file")
+	// FTPS (optional)
+	config.SetDefault("tlsMode", tlsModeNone)
+	context.tlsMode = reader.oneOf("tlsMode", tlsModeNone, tlsModeExplicit, tlsModeImplicit)
+	context.tlsCAFile = reader.file("tlsCAFile")
+	context.tlsCertFile = reader.file("tlsCertFile")
+	context.tlsKeyFile = reader.file("tlsKeyFile")
+	if (context.tlsCertFile == "") != (context.tlsKeyFile == "") {
+		reader.problem("'tlsCertFile' and 'tlsKeyFile' must be set together")
 	}
-	context.syncLocalDir = viper.GetString("syncLocalDir")
+	context.tlsInsecureSkipVerify = reader.boolean("tlsInsecureSkipVerify")
+
+	// Daemon schedule (optional)
+	context.schedule = reader.schedule()
 
-	if viper.Get("compressDir") == nil {
-		panic("[readConfig] Variable 'compressDir' not found in config file")
+	if err := reader.err(); err != nil {
+		return newError(ErrConfig, "readConfig", context.ConfigFilePath, err)
 	}
-	context.compressDir = viper.GetString("compressDir")
+	return nil
 }
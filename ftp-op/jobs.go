@@ -0,0 +1,100 @@
+package ftpop
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/viper"
+)
+
+// configJob is an item of the 'jobs' list of the config file
+type configJob map[string]interface{}
+
+// JobNames returns the names of the jobs of the config file, in order,
+// or nothing if the config file doesn't have a 'jobs' list.
+func JobNames(configFilePath string) ([]string, error) {
+	configFile, err := loadConfigFile(configFilePath)
+	if err != nil {
+		return nil, newError(ErrConfig, "JobNames", configFilePath, err)
+	}
+	jobs, err := configJobs(configFile)
+	if err != nil {
+		return nil, newError(ErrConfig, "JobNames", configFilePath, err)
+	}
+
+	names := make([]string, 0, len(jobs))
+	for _, job := range jobs {
+		names = append(names, job.name())
+	}
+	return names, nil
+}
+
+// configJobs returns the 'jobs' list of the config file. Every job must
+// have an unique name.
+func configJobs(configFile *viper.Viper) ([]configJob, error) {
+	var jobs []configJob
+	if err := configFile.UnmarshalKey("jobs", &jobs); err != nil {
+		return nil, fmt.Errorf("invalid 'jobs' list: %v", err)
+	}
+
+	names := map[string]bool{}
+	for i, job := range jobs {
+		name := job.name()
+		if name == "" {
+			return nil, fmt.Errorf("job %d of the 'jobs' list has no 'name'", i+1)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("job name '%s' is used more than once", name)
+		}
+		names[name] = true
+	}
+	return jobs, nil
+}
+
+// jobConfig returns the config of the job 'jobName': the top-level keys
+// of the config file overridden by the keys of the job. If the config
+// file doesn't have a 'jobs' list, it's the config file itself.
+func jobConfig(configFile *viper.Viper, jobName string) (*viper.Viper, error) {
+	jobs, err := configJobs(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		if jobName != "" {
+			return nil, fmt.Errorf("job '%s' not found, the config file has no 'jobs' list", jobName)
+		}
+		return configFile, nil
+	}
+	if jobName == "" {
+		return nil, errors.New("the config file has a 'jobs' list, a job name is required")
+	}
+
+	for _, job := range jobs {
+		if job.name() != jobName {
+			continue
+		}
+
+		// Top-level keys are the defaults of every job
+		settings := configFile.AllSettings()
+		delete(settings, "jobs")
+
+		config := viper.New()
+		if err := config.MergeConfigMap(settings); err != nil {
+			return nil, err
+		}
+		if err := config.MergeConfigMap(job); err != nil {
+			return nil, err
+		}
+		return config, nil
+	}
+	return nil, fmt.Errorf("job '%s' not found", jobName)
+}
+
+func (job configJob) name() string {
+	for key, value := range job {
+		if key == "name" || key == "Name" {
+			return fmt.Sprint(value)
+		}
+	}
+	return ""
+}
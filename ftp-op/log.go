@@ -0,0 +1,31 @@
+package ftpop
+
+import (
+	"log/slog"
+)
+
+// Actions set in the 'action' field of the log records
+const (
+	actionDownload = "download"
+	actionUpload   = "upload"
+	actionCompress = "compress"
+	actionDelete   = "delete"
+	actionMakeDir  = "mkdir"
+	actionSkip     = "skip"
+)
+
+// logger returns the logger of the progress messages with the job name
+// and dry-run mode as fields
+func (context *ServerContext) logger() *slog.Logger {
+	logger := context.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if context.JobName != "" {
+		logger = logger.With("job", context.JobName)
+	}
+	if context.DryRun {
+		logger = logger.With("dryRun", true)
+	}
+	return logger
+}
@@ -0,0 +1,172 @@
+package ftpop
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Operations set in the 'operation' label of the run metrics
+const (
+	operationSync     = "sync"
+	operationCompress = "compress"
+)
+
+// Metrics collects the Prometheus metrics of the sync and compress runs.
+// The same 'Metrics' can be shared by the 'ServerContext' of many jobs,
+// every metric has a 'job' label.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	files        *prometheus.CounterVec
+	bytes        *prometheus.CounterVec
+	fileDuration *prometheus.HistogramVec
+	fileErrors   *prometheus.CounterVec
+
+	runs        *prometheus.CounterVec
+	runDuration *prometheus.HistogramVec
+	lastSuccess *prometheus.GaugeVec
+}
+
+// NewMetrics creates the metrics in their own registry
+func NewMetrics() *Metrics {
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+		files: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ftpdatasync_files_total",
+			Help: "Files downloaded, uploaded, compressed, deleted or skipped.",
+		}, []string{"job", "action"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ftpdatasync_bytes_total",
+			Help: "Bytes downloaded, uploaded or compressed.",
+		}, []string{"job", "action"}),
+		fileDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ftpdatasync_file_duration_seconds",
+			Help:    "Time to download, upload or compress a file.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+		}, []string{"job", "action"}),
+		fileErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ftpdatasync_file_errors_total",
+			Help: "Files that failed, including the ones skipped by the error handler.",
+		}, []string{"job", "kind"}),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ftpdatasync_runs_total",
+			Help: "Sync and compress runs by result.",
+		}, []string{"job", "operation", "result"}),
+		runDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ftpdatasync_run_duration_seconds",
+			Help:    "Duration of the sync and compress runs.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}, []string{"job", "operation"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ftpdatasync_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful sync and compress runs.",
+		}, []string{"job", "operation"}),
+	}
+	metrics.registry.MustRegister(
+		metrics.files,
+		metrics.bytes,
+		metrics.fileDuration,
+		metrics.fileErrors,
+		metrics.runs,
+		metrics.runDuration,
+		metrics.lastSuccess,
+	)
+	return metrics
+}
+
+// Handler serves the metrics, like on '/metrics'
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+// WriteTextfile writes the metrics to 'path' in the text format read by
+// the node_exporter textfile collector. The file is replaced atomically.
+func (metrics *Metrics) WriteTextfile(path string) error {
+	return prometheus.WriteToTextfile(path, metrics.registry)
+}
+
+// jobMetrics records the metrics of a single job. A nil '*jobMetrics'
+// records nothing.
+type jobMetrics struct {
+	*Metrics
+	job string
+}
+
+// metrics returns the metrics of the job, or nil if 'Metrics' isn't set
+// or in dry-run mode
+func (context *ServerContext) metrics() *jobMetrics {
+	if context.Metrics == nil || context.DryRun {
+		return nil
+	}
+	return &jobMetrics{Metrics: context.Metrics, job: context.JobName}
+}
+
+// addFiles counts files that were deleted or skipped
+func (metrics *jobMetrics) addFiles(action string, files int) {
+	if metrics == nil {
+		return
+	}
+	metrics.files.WithLabelValues(metrics.job, action).Add(float64(files))
+}
+
+// observeFile counts a file that was downloaded, uploaded or compressed
+func (metrics *jobMetrics) observeFile(action string, bytes uint64, duration time.Duration) {
+	if metrics == nil {
+		return
+	}
+	metrics.files.WithLabelValues(metrics.job, action).Inc()
+	metrics.bytes.WithLabelValues(metrics.job, action).Add(float64(bytes))
+	metrics.fileDuration.WithLabelValues(metrics.job, action).Observe(duration.Seconds())
+}
+
+// countError counts a failed file
+func (metrics *jobMetrics) countError(err error) {
+	if metrics == nil {
+		return
+	}
+	metrics.fileErrors.WithLabelValues(metrics.job, errorKindLabel(err)).Inc()
+}
+
+// observeRun records the result and duration of a sync or compress run
+func (metrics *jobMetrics) observeRun(operation string, start time.Time, err error) {
+	if metrics == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.runs.WithLabelValues(metrics.job, operation, result).Inc()
+	metrics.runDuration.WithLabelValues(metrics.job, operation).Observe(time.Since(start).Seconds())
+	if err == nil {
+		metrics.lastSuccess.WithLabelValues(metrics.job, operation).SetToCurrentTime()
+	}
+}
+
+// errorKindLabel returns the 'kind' label of an error
+func errorKindLabel(err error) string {
+	kinds := []struct {
+		kind  error
+		label string
+	}{
+		{ErrConfig, "config"},
+		{ErrConnection, "connection"},
+		{ErrList, "list"},
+		{ErrDownload, "download"},
+		{ErrUpload, "upload"},
+		{ErrDeleteGuard, "delete_guard"},
+		{ErrDelete, "delete"},
+		{ErrCompress, "compress"},
+		{ErrReport, "report"},
+	}
+	for _, kind := range kinds {
+		if errors.Is(err, kind.kind) {
+			return kind.label
+		}
+	}
+	return "unknown"
+}
@@ -1,19 +1,63 @@
 package ftpop
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/jlaffaye/ftp"
+	"github.com/robfig/cron/v3"
 )
 
-// ServerContext is an abstraction of a remote FTP directory
-// and all information relative to it and the FTP server.
+// partFileSuffix is appended to the destination path of a transfer
+// until it's complete. It's specific to this tool so it doesn't match
+// the synced files.
+const partFileSuffix = ".ftpdatasync-part"
+
+// ServerContext is an abstraction of a remote FTP or SFTP directory
+// and all information relative to it and the remote server.
 type ServerContext struct {
 	ConfigFilePath string
+	// JobName selects a job of the 'jobs' list of the config file.
+	// Leave it empty if the config file doesn't have one.
+	JobName string
+
+	// ErrorHandler is called when a single file can't be downloaded or
+	// compressed. Return nil to skip the file and continue, or an error
+	// to abort. If not set, the first error aborts the operation.
+	// It must be safe for concurrent use if 'parallelDownloads' > 1.
+	ErrorHandler func(err error) error
+
+	// DryRun only prints the planned downloads, deletions and
+	// compressions without touching the disk.
+	DryRun bool
+
+	// ForceDelete ignores the mass deletion guard thresholds
+	ForceDelete bool
+
+	// Logger receives the progress messages, with the 'action', 'path',
+	// 'bytes' and 'duration' fields when they apply. The skipped files
+	// are logged at debug level. Defaults to 'slog.Default()'.
+	Logger *slog.Logger
+
+	// Metrics collects the Prometheus metrics of the runs, if set
+	Metrics *Metrics
+
+	// Progress is called every few seconds while a long download runs.
+	// It must be safe for concurrent use if 'parallelDownloads' > 1.
+	Progress func(progress Progress)
+
+	// GlobalRateLimiter limits the downloads of all the jobs sharing it,
+	// see 'NewRateLimiter'. The downloads of each job are also limited
+	// by its own 'downloadRateLimit'.
+	GlobalRateLimiter *RateLimiter
 
 	hostAddress  string
 	hostPort     int
@@ -25,120 +69,441 @@ type ServerContext struct {
 
 	compressDir string
 
-	conn *ftp.ServerConn
+	trashDir           string
+	trashRetentionDays int
+	trashRunDir        string
+
+	deleteGuardMaxFiles   int
+	deleteGuardMaxPercent float64
+
+	filter *pathFilter
+
+	direction         string
+	conflictPolicy    string
+	parallelDownloads int
+	resumeDownloads   bool
+
+	dialTimeout       time.Duration
+	readTimeout       time.Duration
+	dataTimeout       time.Duration
+	keepAliveInterval time.Duration
+	ftpMode           string
+
+	downloadRateLimiter *RateLimiter
+
+	retryMaxAttempts int
+	retryDelay       time.Duration
+	retryMaxDelay    time.Duration
+
+	verifyMode    string
+	timeTolerance time.Duration
+	useMLSD       bool
+	useMDTM       bool
+	stateFilePath string
+
+	// schedule of the runs in daemon mode, nil if not set
+	schedule cron.Schedule
+
+	// state is opened by 'Open' or 'Connect' and closed by 'Disconnect'
+	state *stateDB
+
+	tlsMode               string
+	tlsCAFile             string
+	tlsCertFile           string
+	tlsKeyFile            string
+	tlsInsecureSkipVerify bool
+
+	protocol string
+
+	sshPrivateKeyFile        string
+	sshPrivateKeyPassphrase  string
+	sshKnownHostsFile        string
+	sshInsecureIgnoreHostKey bool
+
+	remote RemoteSource
+
+	// downloadPool is only set during 'Sync' if 'parallelDownloads' > 1
+	downloadPool *downloadPool
+}
+
+// syncPlan holds the changes found by walking the remote directory,
+// so they can be checked before the local directory is touched.
+type syncPlan struct {
+	deletions []*localDeletion
+	downloads []*downloadJob
+
+	// Changes of the remote directory in 'upload' and 'bidirectional'
+	// directions
+	remoteDeletions []*remoteDeletion
+	remoteDirs      []string
+	uploads         []*uploadJob
+	// remoteFiles is the number of files found in the remote directory
+	remoteFiles int
+	// conflicts is the number of files changed on both sides
+	conflicts int
+}
+
+// merge appends the changes planned in 'other'
+func (plan *syncPlan) merge(other *syncPlan) {
+	plan.deletions = append(plan.deletions, other.deletions...)
+	plan.downloads = append(plan.downloads, other.downloads...)
+	plan.remoteDeletions = append(plan.remoteDeletions, other.remoteDeletions...)
+	plan.remoteDirs = append(plan.remoteDirs, other.remoteDirs...)
+	plan.uploads = append(plan.uploads, other.uploads...)
+	plan.remoteFiles += other.remoteFiles
+	plan.conflicts += other.conflicts
+}
+
+// localDeletion is a local file or directory that doesn't exist in remote
+type localDeletion struct {
+	localPath string
+	isDir     bool
+	// files is the number of files removed with it
+	files int
 }
 
 // Connect starts the connection between the client and the remote server.
 // It's important to always disconnect in the end.
 // Example:
-//   context.Disconnect()
-func (context *ServerContext) Connect() {
+//
+//	context.Disconnect()
+func (context *ServerContext) Connect() error {
 	var err error
 
-	// Load config file
-	context.readConfig()
-
-	hostFullAddress := fmt.Sprintf("%s:%d", context.hostAddress, context.hostPort)
+	if err = context.Open(); err != nil {
+		return err
+	}
 
-	// TODO add timeout to connection params
-	context.conn, err = ftp.Dial(hostFullAddress, ftp.DialWithTimeout(5*time.Second))
+	context.remote, err = context.dialRemote()
 	if err != nil {
-		log.Fatal(err)
+		context.closeState()
 	}
+	return err
+}
 
-	err = context.conn.Login(context.hostUser, context.hostPassword)
-	if err != nil {
-		log.Fatal(err)
+// CheckConnection sends a NOOP to the remote server and reconnects if
+// the connection was dropped, like by an idle timeout between the runs
+// of a daemon. It connects if 'Connect' wasn't called or failed.
+func (context *ServerContext) CheckConnection() error {
+	if context.remote != nil {
+		pinger, ok := context.remote.(remotePinger)
+		if !ok {
+			return nil
+		}
+		err := pinger.NoOp()
+		if err == nil {
+			return nil
+		}
+		context.logger().Warn("Connection lost. Reconnecting", "error", err)
+		context.remote.Close()
+		context.remote = nil
 	}
+	return context.Connect()
+}
+
+// Open reads the config file and opens the state database without
+// connecting to the remote server. It's enough for 'Compress',
+// 'CompressCreateReport' and 'Status', which only use the local
+// directories. It's important to always disconnect in the end.
+func (context *ServerContext) Open() error {
+	// Already opened, by 'Connect' or a previous call
+	if context.state != nil {
+		return nil
+	}
+
+	// Load config file
+	if err := context.readConfig(); err != nil {
+		return err
+	}
+
+	// Open the state database
+	return context.openState()
 }
 
 // Disconnect close the connection between the client and the remote server
-func (context *ServerContext) Disconnect() {
-	if err := context.conn.Quit(); err != nil {
-		log.Fatal(err)
+func (context *ServerContext) Disconnect() error {
+	if err := context.closeState(); err != nil {
+		return newError(ErrConfig, "Disconnect", context.stateFilePath, err)
 	}
+
+	if context.remote == nil {
+		return nil
+	}
+	err := context.remote.Close()
+	context.remote = nil
+	if err != nil {
+		return newError(ErrConnection, "Disconnect", context.hostAddress, err)
+	}
+	return nil
 }
 
 // Sync sincronizes files from remote directory to the the local directory
-func (context *ServerContext) Sync() {
+func (context *ServerContext) Sync() error {
+	start := time.Now()
+	err := context.sync()
+	context.metrics().observeRun(operationSync, start, err)
+	return err
+}
+
+func (context *ServerContext) sync() error {
 	remoteDir := context.syncRemoteDir
 	localDir := context.syncLocalDir
 
+	if context.remote == nil {
+		return newError(ErrConnection, "Sync", remoteDir, errors.New("not connected"))
+	}
+
 	// Recursive localDir if not exist
-	ensureDirExist(localDir)
+	if !context.DryRun {
+		if err := ensureDirExist(localDir); err != nil {
+			return newError(ErrDownload, "Sync", localDir, err)
+		}
+	}
 
-	// Copy root dir
-	context.copyDirContent(remoteDir, localDir)
+	if err := context.startTrashRun(); err != nil {
+		return newError(ErrDelete, "Sync", context.trashDir, err)
+	}
+
+	// Remove partial files left by previous runs if they can't be resumed
+	if !context.resumeDownloads {
+		if err := context.cleanupPartFiles(localDir); err != nil {
+			return newError(ErrDelete, "Sync", localDir, err)
+		}
+	}
+
+	// Walk the remote dir before changing anything
+	plan := &syncPlan{}
+	var err error
+	switch context.direction {
+	case directionUpload:
+		var remoteExists bool
+		if remoteExists, err = context.remoteDirExists(remoteDir, plan); err == nil {
+			err = context.planUpload(localDir, remoteDir, remoteExists, plan)
+		}
+	case directionBidirectional:
+		var remoteExists bool
+		if remoteExists, err = context.remoteDirExists(remoteDir, plan); err == nil {
+			remoteState := remoteDirFound
+			if !remoteExists {
+				remoteState = remoteDirNew
+			}
+			err = context.planBidirectional(localDir, remoteDir, remoteState, plan)
+		}
+	default:
+		err = context.copyDirContent(remoteDir, localDir, plan)
+	}
+	if err != nil {
+		return err
+	}
+	if plan.conflicts > 0 {
+		context.logger().Warn("Conflicts found", "conflicts", plan.conflicts)
+	}
+
+	// Abort if too many files would be deleted
+	deletedFiles := 0
+	for _, deletion := range plan.deletions {
+		deletedFiles += deletion.files
+	}
+	countSyncedFiles := func() (int, error) {
+		return countFiles(localDir, func(path string, info os.FileInfo) bool {
+			return !context.isPartialDownload(path)
+		})
+	}
+	if err := context.checkDeleteGuard("Sync", localDir, deletedFiles, countSyncedFiles); err != nil {
+		return err
+	}
+	remoteDeletedFiles := 0
+	for _, deletion := range plan.remoteDeletions {
+		remoteDeletedFiles += deletion.files
+	}
+	countRemoteFiles := func() (int, error) {
+		return plan.remoteFiles, nil
+	}
+	if err := context.checkDeleteGuard("Sync", remoteDir, remoteDeletedFiles, countRemoteFiles); err != nil {
+		return err
+	}
+
+	// Nothing is changed in dry-run mode
+	if context.DryRun {
+		return nil
+	}
+
+	// Delete remote files that doesn't exist locally
+	if err := context.applyRemoteDeletions(plan.remoteDeletions); err != nil {
+		return err
+	}
+
+	// Delete local files that doesn't exist in remote
+	if err := context.applyLocalDeletions(plan.deletions); err != nil {
+		return err
+	}
+
+	if err := context.makeRemoteDirs(plan.remoteDirs); err != nil {
+		return err
+	}
+	if err := context.uploadFiles(plan.uploads); err != nil {
+		return err
+	}
+	if err := context.downloadFiles(plan.downloads); err != nil {
+		return err
+	}
+
+	// Forget the files that don't exist in the local directory anymore
+	if err := context.state.prune(stateBucketFiles, localDir, ""); err != nil {
+		return newError(ErrDelete, "Sync", context.stateFilePath, err)
+	}
+	if err := context.state.prune(stateBucketPartials, localDir, partFileSuffix); err != nil {
+		return newError(ErrDelete, "Sync", context.stateFilePath, err)
+	}
+
+	return nil
 }
 
-// copyDirContent will check the destination path and only replace
+// downloadFiles downloads the planned files, sequentially using the
+// main connection or by the workers of the download pool.
+func (context *ServerContext) downloadFiles(downloads []*downloadJob) error {
+	if len(downloads) == 0 {
+		return nil
+	}
+
+	// Parallel downloads
+	if context.parallelDownloads > 1 {
+		pool, err := context.startDownloadPool(context.parallelDownloads)
+		if err != nil {
+			return err
+		}
+		context.downloadPool = pool
+		defer func() { context.downloadPool = nil }()
+	}
+
+	var err error
+	for _, job := range downloads {
+		context.logger().Debug("Downloading file", "action", actionDownload, "path", job.destinationLocalFilePath, "bytes", job.remoteEntry.Size)
+
+		// Create dir if not exist
+		localDir := filepath.Dir(job.destinationLocalFilePath)
+		if err = ensureDirExist(localDir); err != nil {
+			err = newError(ErrDownload, "downloadFiles", localDir, err)
+			break
+		}
+
+		// Download file
+		if err = context.dispatchDownload(job.remoteEntry, job.remoteFilePath, job.destinationLocalFilePath); err != nil {
+			break
+		}
+	}
+
+	if context.downloadPool != nil {
+		if poolErr := context.downloadPool.wait(); err == nil {
+			err = poolErr
+		}
+	}
+	return err
+}
+
+// copyDirContent will check the destination path and plan the download
 // if the file size is different or doesn't exist
-func (context *ServerContext) copyDirContent(remoteDir string, localDir string) {
-	items, err := context.conn.List(remoteDir)
+func (context *ServerContext) copyDirContent(remoteDir string, localDir string, plan *syncPlan) error {
+	items, err := context.remote.List(remoteDir)
 	if err != nil {
-		check(err, fmt.Sprintf("[copyDirContent] Can't list remoteDir '%s'", remoteDir))
+		return newError(ErrList, "copyDirContent", remoteDir, err)
 	}
 
 	// Delete local files that doesn't exist in remote
-	context.deleteLocalFiles(items, remoteDir, localDir)
+	if err := context.deleteLocalFiles(items, remoteDir, localDir, plan); err != nil {
+		return err
+	}
 
 	for _, item := range items {
-		if item.Type == 1 {
+		remoteEntryPath := fmt.Sprintf("%s/%s", remoteDir, item.Name)
+		if item.IsDir {
+			// Skip excluded directories
+			if !context.filter.matchDir(relativePath(context.syncRemoteDir, remoteEntryPath)) {
+				context.logger().Debug("Dir excluded", "action", actionSkip, "path", remoteEntryPath)
+				continue
+			}
+
 			// Recursive call if is a directory
-			context.copyDirContent(
+			err := context.copyDirContent(
 				fmt.Sprintf("%s/%s", remoteDir, item.Name),
 				fmt.Sprintf("%s/%s", localDir, item.Name),
+				plan,
 			)
+			if err != nil {
+				return err
+			}
 
 		} else {
+			// Skip excluded files
+			if !context.filter.matchFile(relativePath(context.syncRemoteDir, remoteEntryPath)) {
+				context.logger().Debug("File excluded", "action", actionSkip, "path", remoteEntryPath)
+				context.metrics().addFiles(actionSkip, 1)
+				continue
+			}
+
 			// Download file if the remote and local file aren't equal
 			// or local file doesn't exist
-			remoteFilePath := fmt.Sprintf("%s/%s", remoteDir, item.Name)
+			remoteFilePath := remoteEntryPath
 			destinationLocalFilePath := fmt.Sprintf("%s/%s", localDir, item.Name)
-			if context.fileHasChange(item, destinationLocalFilePath) {
-				fmt.Println("Downloading file to...", destinationLocalFilePath)
-				// Create dir if not exist
-				ensureDirExist(localDir)
+			if context.fileHasChange(item, remoteFilePath, destinationLocalFilePath) {
+				if context.DryRun {
+					context.logger().Info("Would download file", "action", actionDownload, "path", destinationLocalFilePath, "bytes", item.Size)
+				}
 
-				// Download file
-				context.downloadFile(item, remoteFilePath, destinationLocalFilePath)
+				plan.downloads = append(plan.downloads, &downloadJob{
+					remoteEntry:              item,
+					remoteFilePath:           remoteFilePath,
+					destinationLocalFilePath: destinationLocalFilePath,
+				})
 			} else {
-				fmt.Println("File already exist. Skipping...", destinationLocalFilePath)
+				context.logger().Debug("File already exist", "action", actionSkip, "path", destinationLocalFilePath)
+				context.metrics().addFiles(actionSkip, 1)
 			}
 			// debug(item)
 			// fmt.Println(remoteDir, item.Name)
 
 		}
 	}
+
+	return nil
 }
 
-// deleteLocalFiles deletes all local files that doesn't exist in remote directory
-func (context *ServerContext) deleteLocalFiles(remoteEntries []*ftp.Entry, remoteDir string, localDir string) {
-	// Just return if 'localDir' doesn't exist
-	if _, err := os.Stat(localDir); os.IsNotExist(err) {
-		return
+// deleteLocalFiles plans the deletion of all local files that doesn't exist in remote directory
+func (context *ServerContext) deleteLocalFiles(remoteEntries []*RemoteEntry, remoteDir string, localDir string, plan *syncPlan) error {
+	// Just return if 'localDir' doesn't exist. It can also be a file,
+	// or inside one, replaced by a remote directory: the file is
+	// already planned for deletion by the parent directory.
+	info, err := os.Stat(localDir)
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) || (err == nil && !info.IsDir()) {
+		return nil
 	}
 
 	// Get list of 'localEntries' in 'localDir'
 	localEntries, err := ioutil.ReadDir(localDir)
 	if err != nil {
-		log.Fatal(err)
+		return newError(ErrList, "deleteLocalFiles", localDir, err)
 	}
 
 	// Check if exist in remote
 	for _, localEntry := range localEntries { // for each localEntry
 		localEntryFoundInRemote := false
 
+		// Partial downloads are kept while the remote file exists
+		localEntryName := localEntry.Name()
+		if !localEntry.IsDir() && context.isPartialDownload(fmt.Sprintf("%s/%s", localDir, localEntryName)) {
+			localEntryName = strings.TrimSuffix(localEntryName, partFileSuffix)
+		}
+
 		// Search localFile in remoteEntries
 		// TODO probably exist a better way to do it
 		for _, remoteEntry := range remoteEntries {
-			if remoteEntry.Type == 1 { // Is a directory
+			if remoteEntry.IsDir { // Is a directory
 				if localEntry.IsDir() && localEntry.Name() == remoteEntry.Name {
 					localEntryFoundInRemote = true
 				}
 
 			} else { // Is a file
-				if !localEntry.IsDir() && localEntry.Name() == remoteEntry.Name {
+				if !localEntry.IsDir() && (localEntry.Name() == remoteEntry.Name || localEntryName == remoteEntry.Name) {
 					localEntryFoundInRemote = true
 				}
 			}
@@ -148,30 +513,118 @@ func (context *ServerContext) deleteLocalFiles(remoteEntries []*ftp.Entry, remot
 		if !localEntryFoundInRemote {
 			localEntryPath := fmt.Sprintf("%s/%s", localDir, localEntry.Name())
 
-			fmt.Printf("File '%s' not found on remote. Removing...\n", localEntryPath)
+			// Keep the local files excluded from the sync
+			localEntryRelativePath := relativePath(context.syncLocalDir, fmt.Sprintf("%s/%s", localDir, localEntryName))
+			if localEntry.IsDir() && !context.filter.matchDir(localEntryRelativePath) {
+				continue
+			}
+			if !localEntry.IsDir() && !context.filter.matchFile(localEntryRelativePath) {
+				continue
+			}
 
+			if context.DryRun {
+				context.logger().Info("File not found on remote. Would remove it", "action", actionDelete, "path", localEntryPath)
+			}
+
+			deletion := &localDeletion{localPath: localEntryPath, isDir: localEntry.IsDir(), files: 1}
 			if localEntry.IsDir() {
-				os.RemoveAll(localEntryPath)
-			} else {
-				os.Remove(localEntryPath)
+				deletion.files, err = context.countLocalFiles(localEntryPath)
+				if err != nil {
+					return newError(ErrList, "deleteLocalFiles", localEntryPath, err)
+				}
 			}
+			plan.deletions = append(plan.deletions, deletion)
 		}
 
 	}
 
+	return nil
+}
+
+// applyLocalDeletions deletes the local files planned by 'deleteLocalFiles'
+func (context *ServerContext) applyLocalDeletions(deletions []*localDeletion) error {
+	for _, deletion := range deletions {
+		context.logger().Info("File not found on remote. Removing it", "action", actionDelete, "path", deletion.localPath)
+
+		var err error
+		if deletion.isDir {
+			err = context.removeLocalDir(deletion.localPath)
+		} else {
+			err = context.removeLocal(trashAreaSync, deletion.localPath)
+		}
+		if err != nil {
+			return newError(ErrDelete, "applyLocalDeletions", deletion.localPath, err)
+		}
+		context.metrics().addFiles(actionDelete, deletion.files)
+	}
+
+	return nil
+}
+
+// removeLocalDir removes a local directory that doesn't exist in
+// remote, keeping the files excluded from the sync inside it.
+func (context *ServerContext) removeLocalDir(localDir string) error {
+	if context.filter.isEmpty() {
+		return context.removeLocal(trashAreaSync, localDir)
+	}
+
+	localEntries, err := ioutil.ReadDir(localDir)
+	if err != nil {
+		return err
+	}
+	for _, localEntry := range localEntries {
+		localEntryPath := fmt.Sprintf("%s/%s", localDir, localEntry.Name())
+		localEntryRelativePath := relativePath(context.syncLocalDir, strings.TrimSuffix(localEntryPath, partFileSuffix))
+		if localEntry.IsDir() {
+			if context.filter.matchDir(localEntryRelativePath) {
+				err = context.removeLocalDir(localEntryPath)
+			}
+		} else if context.filter.matchFile(localEntryRelativePath) {
+			err = context.removeLocal(trashAreaSync, localEntryPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only remove the dir if nothing was kept
+	localEntries, err = ioutil.ReadDir(localDir)
+	if err != nil || len(localEntries) > 0 {
+		return err
+	}
+	return os.Remove(localDir)
+}
+
+// modTimeIsEqual returns 'true' if the remote and local modification
+// times differ by 'timeTolerance' at most.
+func (context *ServerContext) modTimeIsEqual(remoteTime time.Time, localTime time.Time) bool {
+	difference := remoteTime.Sub(localTime)
+	if difference < 0 {
+		difference = -difference
+	}
+	return difference <= context.timeTolerance
 }
 
 // fileHasChange returns 'true' if the has change between remote and local file
 // and return false if files are equal.
-func (context *ServerContext) fileHasChange(remoteEntry *ftp.Entry, destinationLocalFilePath string) bool {
+func (context *ServerContext) fileHasChange(remoteEntry *RemoteEntry, remoteFilePath string, destinationLocalFilePath string) bool {
+	if context.verifyMode == verifyModeHash {
+		return context.hashHasChange(remoteEntry, remoteFilePath, destinationLocalFilePath)
+	}
+
 	// Check if file already exist
 	if checkLocalFileExists(destinationLocalFilePath) {
+		fileStat, err := os.Stat(destinationLocalFilePath)
+		if err != nil {
+			// Can't compare, so download it again
+			return true
+		}
+
 		// Check if file size is equal
-		sizeIsEqual := bool(remoteEntry.Size == getLocalFileSize(destinationLocalFilePath))
+		sizeIsEqual := bool(remoteEntry.Size == uint64(fileStat.Size()))
 
 		// Check if createAt datetime is equal
-		fileStat, _ := os.Stat(destinationLocalFilePath)
-		modTimeIsEqual := remoteEntry.Time.Equal(fileStat.ModTime())
+		modTimeIsEqual := context.modTimeIsEqual(remoteEntry.Time, fileStat.ModTime())
 
 		if sizeIsEqual && modTimeIsEqual {
 			return false
@@ -185,45 +638,224 @@ func (context *ServerContext) fileHasChange(remoteEntry *ftp.Entry, destinationL
 	return true
 }
 
-func (context *ServerContext) downloadFile(remoteEntry *ftp.Entry, remoteFilePath string, destinationLocalFilePath string) {
-	// Download remote file
-	res, err := context.conn.Retr(remoteFilePath)
+// dispatchDownload downloads the file with the main connection or
+// queues it in the download pool if parallel downloads are enabled.
+func (context *ServerContext) dispatchDownload(remoteEntry *RemoteEntry, remoteFilePath string, destinationLocalFilePath string) error {
+	if context.downloadPool != nil {
+		return context.downloadPool.submit(&downloadJob{
+			remoteEntry:              remoteEntry,
+			remoteFilePath:           remoteFilePath,
+			destinationLocalFilePath: destinationLocalFilePath,
+		})
+	}
+
+	err := context.retryTransfer(context.remote, "downloadFile", remoteFilePath, func() error {
+		return context.downloadFile(context.remote, remoteEntry, remoteFilePath, destinationLocalFilePath)
+	})
+	return context.handleError(err)
+}
+
+// downloadFile streams the remote file to a partial file next to the
+// destination and only renames it into place when it's complete and
+// flushed to disk, so the destination is never a truncated file.
+// If a previous download of the same remote file was interrupted,
+// it resumes from the size of the partial file.
+func (context *ServerContext) downloadFile(remote RemoteSource, remoteEntry *RemoteEntry, remoteFilePath string, destinationLocalFilePath string) error {
+	start := time.Now()
+	partFilePath := destinationLocalFilePath + partFileSuffix
+	remoteFileModTime := remoteEntry.Time
+
+	relativeFilePath := relativePath(context.syncRemoteDir, remoteFilePath)
+
+	// Resume partial download
+	var offset uint64
+	if context.resumeDownloads {
+		partial, err := context.state.getPartial(relativeFilePath)
+		if err != nil {
+			return newError(ErrDownload, "downloadFile", context.stateFilePath, err)
+		}
+		offset = partialDownloadOffset(remoteEntry, partial, partFilePath)
+	}
+	resumedOffset := offset
+
+	// Hash the content while it's downloaded, starting with the resumed
+	// part, to record it without reading the file again
+	contentHash := sha1.New()
+	if offset > 0 {
+		if err := hashFilePrefix(contentHash, partFilePath, offset); err != nil {
+			return newError(ErrDownload, "downloadFile", partFilePath, err)
+		}
+	}
+
+	if offset < remoteEntry.Size || !fileExists(partFilePath) {
+		if offset > 0 {
+			context.logger().Info("Resuming download", "action", actionDownload, "path", destinationLocalFilePath, "offset", offset)
+		} else {
+			// Record which version of the remote file the partial file
+			// belongs to, so the next run knows if it can be resumed
+			err := context.state.put(stateBucketPartials, relativeFilePath, &partialState{
+				Size:      remoteEntry.Size,
+				Time:      remoteEntry.Time,
+				StartedAt: time.Now(),
+			})
+			if err != nil {
+				return newError(ErrDownload, "downloadFile", context.stateFilePath, err)
+			}
+		}
+
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if offset > 0 {
+			flags = os.O_WRONLY | os.O_APPEND
+		}
+		f, err := os.OpenFile(partFilePath, flags, 0644)
+		if err != nil {
+			return newError(ErrDownload, "downloadFile", partFilePath, err)
+		}
+
+		// Download remote file
+		res, err := remote.Retrieve(remoteFilePath, offset)
+		if err != nil {
+			f.Close()
+			return newError(ErrDownload, "downloadFile", remoteFilePath, err)
+		}
+		res = context.throttle(res)
+
+		// Write file on local storage
+		progress := newProgressWriter(context.Progress, destinationLocalFilePath, offset, remoteEntry.Size)
+		written, err := copyDownload(f, res, contentHash, progress)
+		if closeErr := res.Close(); err == nil {
+			err = closeErr
+		}
+		if syncErr := f.Sync(); err == nil {
+			err = syncErr
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			return newError(ErrDownload, "downloadFile", remoteFilePath, err)
+		}
+		offset += uint64(written)
+	}
+
+	// Only replace the destination file if the download is complete
+	if offset != remoteEntry.Size {
+		if offset > remoteEntry.Size {
+			os.Remove(partFilePath)
+		}
+		return newError(ErrDownload, "downloadFile", remoteFilePath,
+			fmt.Errorf("downloaded %d bytes, expected %d", offset, remoteEntry.Size))
+	}
+
+	// Set 'access' and 'modification' time of downloaded file
+	err := os.Chtimes(partFilePath, remoteFileModTime, remoteFileModTime)
+	if err != nil {
+		return newError(ErrDownload, "downloadFile", partFilePath, err)
+	}
+	err = os.Rename(partFilePath, destinationLocalFilePath)
 	if err != nil {
-		check(err, fmt.Sprintf("[downloadFile] Unable to download the file '%s'", remoteFilePath))
+		return newError(ErrDownload, "downloadFile", destinationLocalFilePath, err)
 	}
-	defer res.Close()
 
-	// Write file on local storage
-	buf, err := ioutil.ReadAll(res)
-	err = ioutil.WriteFile(destinationLocalFilePath, buf, 0644)
+	// Persist the rename
+	err = syncDir(filepath.Dir(destinationLocalFilePath))
 	if err != nil {
-		log.Fatal(err)
+		return newError(ErrDownload, "downloadFile", destinationLocalFilePath, err)
 	}
 
-	// Set 'access' and 'modification' time of downloaded file
-	remoteFileModTime := remoteEntry.Time
-	os.Chtimes(destinationLocalFilePath, remoteFileModTime, remoteFileModTime)
+	err = context.recordDownload(remoteEntry, remoteFilePath, hex.EncodeToString(contentHash.Sum(nil)))
+	if err != nil {
+		return newError(ErrDownload, "downloadFile", destinationLocalFilePath, err)
+	}
+
+	duration := time.Since(start)
+	context.logger().Info("Downloaded file", "action", actionDownload, "path", destinationLocalFilePath,
+		"bytes", remoteEntry.Size, "duration", duration)
+	context.metrics().observeFile(actionDownload, remoteEntry.Size-resumedOffset, duration)
+	return nil
 }
 
-// checkLocalFileExists checks if a file exists and is not a directory before we
-// try using it to prevent further errors.
-func checkLocalFileExists(filename string) bool {
-	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		return false
+// partialDownloadOffset returns the size of the partial file if the
+// state database says it was created from the same version of the
+// remote file, otherwise 0.
+func partialDownloadOffset(remoteEntry *RemoteEntry, partial *partialState, partFilePath string) uint64 {
+	if partial == nil || partial.Size != remoteEntry.Size || !partial.Time.Equal(remoteEntry.Time) {
+		return 0
 	}
-	return !info.IsDir()
+
+	fileStat, err := os.Stat(partFilePath)
+	if err != nil || fileStat.IsDir() {
+		return 0
+	}
+
+	size := uint64(fileStat.Size())
+	if size > remoteEntry.Size {
+		return 0
+	}
+	return size
 }
 
-func getLocalFileSize(filePath string) uint64 {
-	file, err := os.Open(filePath)
-	if err != nil {
-		log.Fatal(err)
+// relativePath returns 'fullPath' relative to 'rootDir'. Both paths
+// must use '/' as separator.
+func relativePath(rootDir string, fullPath string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(fullPath, rootDir), "/")
+}
+
+// isPartFile returns 'true' if 'fileName' has the suffix of a partial
+// transfer
+func isPartFile(fileName string) bool {
+	return strings.HasSuffix(fileName, partFileSuffix)
+}
+
+// isPartialDownload returns 'true' if 'localPath' is the partial file of
+// a download recorded in the state database. Other files with the same
+// suffix are synced like any file.
+func (context *ServerContext) isPartialDownload(localPath string) bool {
+	if !isPartFile(localPath) {
+		return false
 	}
-	fi, err := file.Stat()
+	relativeFilePath, err := context.localRelativePath(strings.TrimSuffix(localPath, partFileSuffix))
 	if err != nil {
-		log.Fatal(err)
+		return false
 	}
+	partial, err := context.state.getPartial(relativeFilePath)
+	return err == nil && partial != nil
+}
 
-	return uint64(fi.Size())
+// cleanupPartFiles removes all partial downloads inside 'localDir'.
+// Only the files recorded in the state database are removed.
+func (context *ServerContext) cleanupPartFiles(localDir string) error {
+	if _, err := os.Stat(localDir); os.IsNotExist(err) {
+		return nil
+	}
+
+	err := filepath.Walk(localDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && context.isPartialDownload(path) {
+			if context.DryRun {
+				context.logger().Info("Would remove partial file", "action", actionDelete, "path", path)
+				return nil
+			}
+			context.logger().Info("Removing partial file", "action", actionDelete, "path", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil || context.DryRun {
+		return err
+	}
+	return context.state.clearPartials()
+}
+
+// checkLocalFileExists checks if a file exists and is not a directory before we
+// try using it to prevent further errors.
+func checkLocalFileExists(filename string) bool {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false
+	}
+	return !info.IsDir()
 }
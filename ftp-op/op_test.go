@@ -0,0 +1,102 @@
+package ftpop
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSyncFileReplacedByDir(t *testing.T) {
+	tests := []struct {
+		name string
+		// dirs and files replace the remote file '/data/a'
+		dirs      []string
+		files     []string
+		dryRun    bool
+		wantLocal []string
+	}{
+		{
+			name:      "file replaced by a dir",
+			dirs:      []string{"/data/a"},
+			files:     []string{"/data/a/x.txt"},
+			wantLocal: []string{"a/x.txt", "b.txt"},
+		},
+		{
+			name:      "file replaced by nested dirs",
+			dirs:      []string{"/data/a", "/data/a/sub"},
+			files:     []string{"/data/a/sub/y.txt"},
+			wantLocal: []string{"a/sub/y.txt", "b.txt"},
+		},
+		{
+			name:      "dry-run",
+			dirs:      []string{"/data/a", "/data/a/sub"},
+			files:     []string{"/data/a/x.txt", "/data/a/sub/y.txt"},
+			dryRun:    true,
+			wantLocal: []string{"a", "b.txt"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remote := newFakeRemote("/data")
+			remote.writeFile("/data/a", "file")
+			remote.writeFile("/data/b.txt", "b")
+			context := newBidirectionalContext(t, remote)
+			context.direction = directionDownload
+			if err := context.Sync(); err != nil {
+				t.Fatalf("first sync: %v", err)
+			}
+
+			remote.Remove("/data/a")
+			for _, dir := range test.dirs {
+				remote.MakeDir(dir)
+			}
+			for _, file := range test.files {
+				remote.writeFile(file, "content")
+			}
+
+			// Run twice, the second run must find nothing to fix
+			context.DryRun = test.dryRun
+			for run := 1; run <= 2; run++ {
+				if err := context.Sync(); err != nil {
+					t.Fatalf("sync %d: %v", run, err)
+				}
+			}
+
+			if got := localFiles(t, context); strings.Join(got, ",") != strings.Join(test.wantLocal, ",") {
+				t.Errorf("local files: got %v, want %v", got, test.wantLocal)
+			}
+			if !test.dryRun {
+				if _, err := os.Stat(filepath.Join(context.syncLocalDir, "a")); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckLocalFileExists(t *testing.T) {
+	dir := t.TempDir()
+	filePath := filepath.Join(dir, "a")
+	if err := os.WriteFile(filePath, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: filePath, want: true},
+		{path: dir, want: false},
+		{path: filepath.Join(dir, "missing"), want: false},
+		// Inside a file, Stat fails with ENOTDIR
+		{path: filepath.Join(filePath, "x.txt"), want: false},
+	}
+
+	for _, test := range tests {
+		if got := checkLocalFileExists(test.path); got != test.want {
+			t.Errorf("checkLocalFileExists(%s): got %v, want %v", test.path, got, test.want)
+		}
+	}
+}
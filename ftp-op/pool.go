@@ -0,0 +1,115 @@
+package ftpop
+
+import (
+	"sync"
+)
+
+// downloadJob is a file waiting to be downloaded
+type downloadJob struct {
+	remoteEntry              *RemoteEntry
+	remoteFilePath           string
+	destinationLocalFilePath string
+}
+
+// downloadPool dispatches downloads to a bounded number of workers.
+// Each worker has its own connection to the remote server because
+// the connections can't be shared between goroutines.
+type downloadPool struct {
+	context *ServerContext
+	remotes []RemoteSource
+
+	jobs  chan *downloadJob
+	abort chan struct{}
+	wg    sync.WaitGroup
+
+	once sync.Once
+	err  error
+}
+
+// startDownloadPool opens 'size' connections to the remote server
+// and starts one worker for each one.
+func (context *ServerContext) startDownloadPool(size int) (*downloadPool, error) {
+	pool := &downloadPool{
+		context: context,
+		jobs:    make(chan *downloadJob, size),
+		abort:   make(chan struct{}),
+	}
+
+	for i := 0; i < size; i++ {
+		remote, err := context.dialRemote()
+		if err != nil {
+			pool.closeRemotes()
+			return nil, err
+		}
+		pool.remotes = append(pool.remotes, remote)
+	}
+
+	for _, remote := range pool.remotes {
+		pool.wg.Add(1)
+		go pool.worker(remote)
+	}
+
+	return pool, nil
+}
+
+func (pool *downloadPool) worker(remote RemoteSource) {
+	defer pool.wg.Done()
+
+	for job := range pool.jobs {
+		select {
+		case <-pool.abort:
+			// Drain the queue after a fatal error
+			continue
+		default:
+		}
+
+		err := pool.context.retryTransfer(remote, "downloadFile", job.remoteFilePath, func() error {
+			return pool.context.downloadFile(remote, job.remoteEntry, job.remoteFilePath, job.destinationLocalFilePath)
+		})
+		if err = pool.context.handleError(err); err != nil {
+			pool.fail(err)
+		}
+	}
+}
+
+// fail stores the first fatal error and stops the dispatch of new jobs
+func (pool *downloadPool) fail(err error) {
+	pool.once.Do(func() {
+		pool.err = err
+		close(pool.abort)
+	})
+}
+
+// submit queues a new download. Returns the fatal error of a
+// worker if the pool was aborted.
+func (pool *downloadPool) submit(job *downloadJob) error {
+	select {
+	case pool.jobs <- job:
+		return nil
+	case <-pool.abort:
+		return pool.err
+	}
+}
+
+// wait waits for all queued downloads, closes the connections
+// of the workers and returns the first fatal error.
+func (pool *downloadPool) wait() error {
+	close(pool.jobs)
+	pool.wg.Wait()
+	pool.closeRemotes()
+
+	// 'pool.err' is only written before 'abort' is closed
+	select {
+	case <-pool.abort:
+		return pool.err
+	default:
+		return nil
+	}
+}
+
+func (pool *downloadPool) closeRemotes() {
+	for _, remote := range pool.remotes {
+		remote.Close()
+	}
+	pool.remotes = nil
+}
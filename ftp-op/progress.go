@@ -0,0 +1,80 @@
+package ftpop
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// downloadBufferSize is the memory used to copy each download to disk,
+// whatever the size of the file
+const downloadBufferSize = 256 * 1024
+
+// progressInterval is the minimum time between two 'Progress' calls of
+// the same transfer, so only the long transfers report their progress
+const progressInterval = 5 * time.Second
+
+// Progress is the state of a running download, passed to
+// 'ServerContext.Progress'
+type Progress struct {
+	// Path is the local destination of the file
+	Path string
+	// Bytes is the size downloaded so far, including the resumed part
+	Bytes uint64
+	// Size is the size of the remote file
+	Size uint64
+	// Elapsed is the time since the start of the download
+	Elapsed time.Duration
+}
+
+// progressWriter counts the bytes written and calls 'report' every
+// 'progressInterval'
+type progressWriter struct {
+	progress Progress
+	report   func(progress Progress)
+
+	start      time.Time
+	lastReport time.Time
+}
+
+func newProgressWriter(report func(progress Progress), path string, offset uint64, size uint64) *progressWriter {
+	now := time.Now()
+	return &progressWriter{
+		progress:   Progress{Path: path, Bytes: offset, Size: size},
+		report:     report,
+		start:      now,
+		lastReport: now,
+	}
+}
+
+func (writer *progressWriter) Write(b []byte) (int, error) {
+	writer.progress.Bytes += uint64(len(b))
+	if writer.report != nil && time.Since(writer.lastReport) >= progressInterval {
+		writer.lastReport = time.Now()
+		writer.progress.Elapsed = writer.lastReport.Sub(writer.start)
+		writer.report(writer.progress)
+	}
+	return len(b), nil
+}
+
+// copyDownload copies 'src' to 'dst' with a buffer of 'downloadBufferSize'
+// and writes the copied content to 'observers' too, like a hash or a
+// 'progressWriter'
+func copyDownload(dst io.Writer, src io.Reader, observers ...io.Writer) (int64, error) {
+	// MultiWriter doesn't implement 'io.ReaderFrom', so the copy always
+	// uses the buffer
+	writer := io.MultiWriter(append([]io.Writer{dst}, observers...)...)
+	return io.CopyBuffer(writer, src, make([]byte, downloadBufferSize))
+}
+
+// hashFilePrefix writes the first 'size' bytes of a file to 'hash'
+func hashFilePrefix(hash io.Writer, filePath string, size uint64) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.CopyBuffer(hash, io.LimitReader(file, int64(size)), make([]byte, downloadBufferSize))
+	return err
+}
@@ -0,0 +1,91 @@
+package ftpop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Protocols accepted by the 'protocol' config key
+const (
+	protocolFTP  = "ftp"
+	protocolSFTP = "sftp"
+)
+
+// RemoteEntry is a file or directory found in the remote server.
+type RemoteEntry struct {
+	Name  string
+	IsDir bool
+	Size  uint64
+	Time  time.Time
+}
+
+// RemoteSource is an abstraction of the remote server the files are
+// synchronized with. Each protocol has its own implementation.
+type RemoteSource interface {
+	// List returns the entries of the remote directory 'path'
+	List(path string) ([]*RemoteEntry, error)
+	// Retrieve opens the remote file 'path' for reading, starting
+	// at the byte 'offset'
+	Retrieve(path string, offset uint64) (io.ReadCloser, error)
+	// Stat returns the entry of the remote file or directory 'path', or
+	// an error wrapping 'os.ErrNotExist' if it doesn't exist
+	Stat(path string) (*RemoteEntry, error)
+	// Store creates or replaces the remote file 'path' with the
+	// content of 'r'
+	Store(path string, r io.Reader) error
+	// Rename moves the remote file 'from' to 'to', replacing it
+	Rename(from string, to string) error
+	// MakeDir creates the remote directory 'path'
+	MakeDir(path string) error
+	// Remove deletes the remote file 'path'
+	Remove(path string) error
+	// RemoveDir deletes the remote directory 'path' and its content
+	RemoveDir(path string) error
+	// Close terminates the connection with the remote server
+	Close() error
+}
+
+// errSetTimeNotSupported is returned by 'SetTime' when the server can't
+// change the modification time of its files.
+var errSetTimeNotSupported = errors.New("server doesn't support setting modification times")
+
+// remoteTimeSetter is implemented by the remote sources able to change
+// the modification time of a remote file.
+type remoteTimeSetter interface {
+	SetTime(path string, t time.Time) error
+}
+
+// remotePinger is implemented by the remote sources able to check that
+// the connection is still alive without side effects.
+type remotePinger interface {
+	NoOp() error
+}
+
+// remoteHasher is implemented by the remote sources able to compute
+// the hash of a remote file on the server side.
+type remoteHasher interface {
+	// Hash returns the algorithm ('getHashFromFile' name) and the hex
+	// encoded hash of the remote file 'path'
+	Hash(path string) (string, string, error)
+}
+
+// dialProtocol opens a new connection to the remote server using
+// the protocol set in the config file, without retries.
+func (context *ServerContext) dialProtocol() (RemoteSource, error) {
+	switch context.protocol {
+	case protocolSFTP:
+		return context.dialSFTP()
+	case protocolFTP:
+		return context.dialFTP()
+	}
+	return nil, newError(ErrConfig, "dialProtocol", context.ConfigFilePath,
+		fmt.Errorf("protocol '%s' not supported", context.protocol))
+}
+
+// isSpecialDirName returns 'true' for the '.' and '..' entries
+// returned by some servers.
+func isSpecialDirName(name string) bool {
+	return name == "." || name == ".."
+}
@@ -0,0 +1,213 @@
+package ftpop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"path"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// ftpSource is the 'RemoteSource' implementation for FTP and FTPS servers
+type ftpSource struct {
+	conn *ftp.ServerConn
+
+	// Get the modification time of each file with MDTM when the listing
+	// doesn't have precise times
+	useMDTM bool
+
+	// The hash connection is only opened when the first hash is requested
+	dialHash func() (*ftpHashConn, error)
+	hashConn *ftpHashConn
+	hashErr  error
+}
+
+func (context *ServerContext) dialFTP() (RemoteSource, error) {
+	hostFullAddress := fmt.Sprintf("%s:%d", context.hostAddress, context.hostPort)
+
+	tlsConfig, err := context.tlsConfig()
+	if err != nil {
+		return nil, newError(ErrConfig, "dialFTP", context.ConfigFilePath, err)
+	}
+
+	dialOptions := []ftp.DialOption{
+		ftp.DialWithDialFunc(context.ftpDialFunc(tlsConfig)),
+		// MLSD is used by 'List' if the server supports it
+		ftp.DialWithDisabledMLSD(!context.useMLSD),
+		// EPSV is used if the server supports it, unless PASV is forced.
+		// In active mode, PASV is replaced by PORT.
+		ftp.DialWithDisabledEPSV(context.ftpMode != ftpModeEPSV),
+	}
+
+	// FTPS. In active mode, the explicit TLS upgrade is done by the dial
+	// function.
+	switch context.tlsMode {
+	case tlsModeExplicit:
+		if context.ftpMode != ftpModeActive {
+			dialOptions = append(dialOptions, ftp.DialWithExplicitTLS(tlsConfig))
+		}
+	case tlsModeImplicit:
+		dialOptions = append(dialOptions, ftp.DialWithTLS(tlsConfig))
+	}
+
+	conn, err := ftp.Dial(hostFullAddress, dialOptions...)
+	if err != nil {
+		return nil, newError(ErrConnection, "dialFTP", hostFullAddress, err)
+	}
+
+	err = conn.Login(context.hostUser, context.hostPassword)
+	if err != nil {
+		conn.Quit()
+		return nil, newError(ErrConnection, "dialFTP", hostFullAddress, err)
+	}
+
+	source := &ftpSource{
+		conn:     conn,
+		useMDTM:  context.useMDTM && !conn.IsTimePreciseInList() && conn.IsGetTimeSupported(),
+		dialHash: context.dialFTPHash,
+	}
+	return source, nil
+}
+
+func (source *ftpSource) List(remotePath string) ([]*RemoteEntry, error) {
+	items, err := source.conn.List(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*RemoteEntry, 0, len(items))
+	for _, item := range items {
+		if isSpecialDirName(item.Name) {
+			continue
+		}
+		entry := newFTPRemoteEntry(item)
+
+		// LIST times have minute or day precision, ask for the exact one
+		if source.useMDTM && !entry.IsDir {
+			if modTime, err := source.conn.GetTime(path.Join(remotePath, item.Name)); err == nil {
+				entry.Time = modTime
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (source *ftpSource) Retrieve(remotePath string, offset uint64) (io.ReadCloser, error) {
+	return source.conn.RetrFrom(remotePath, offset)
+}
+
+func (source *ftpSource) Stat(remotePath string) (*RemoteEntry, error) {
+	remotePath = path.Clean(remotePath)
+
+	// Use MLST if the server supports it
+	item, err := source.conn.GetEntry(remotePath)
+	if err == nil {
+		entry := newFTPRemoteEntry(item)
+		entry.Name = path.Base(remotePath)
+		return entry, nil
+	}
+	var protocolErr *textproto.Error
+	if !errors.As(err, &protocolErr) || protocolErr.Code != ftp.StatusNotImplemented {
+		if isFTPNotFound(err) {
+			return nil, fmt.Errorf("'%s' %w", remotePath, os.ErrNotExist)
+		}
+		return nil, err
+	}
+
+	// The root dir has no parent, it exists if it can be listed
+	if remotePath == "/" || remotePath == "." {
+		if _, err := source.List(remotePath); err != nil {
+			return nil, err
+		}
+		return &RemoteEntry{Name: remotePath, IsDir: true}, nil
+	}
+
+	// Else search the entry in the parent dir
+	items, err := source.List(path.Dir(remotePath))
+	if err != nil {
+		if isFTPNotFound(err) {
+			return nil, fmt.Errorf("'%s' %w", remotePath, os.ErrNotExist)
+		}
+		return nil, err
+	}
+	for _, item := range items {
+		if item.Name == path.Base(remotePath) {
+			return item, nil
+		}
+	}
+	return nil, fmt.Errorf("'%s' %w", remotePath, os.ErrNotExist)
+}
+
+// isFTPNotFound returns 'true' for the '550' reply of a path that
+// doesn't exist
+func isFTPNotFound(err error) bool {
+	var protocolErr *textproto.Error
+	return errors.As(err, &protocolErr) && protocolErr.Code == ftp.StatusFileUnavailable
+}
+
+func (source *ftpSource) Store(remotePath string, r io.Reader) error {
+	return source.conn.Stor(remotePath, r)
+}
+
+func (source *ftpSource) Rename(from string, to string) error {
+	return source.conn.Rename(from, to)
+}
+
+func (source *ftpSource) MakeDir(remotePath string) error {
+	return source.conn.MakeDir(remotePath)
+}
+
+func (source *ftpSource) Remove(remotePath string) error {
+	return source.conn.Delete(remotePath)
+}
+
+func (source *ftpSource) RemoveDir(remotePath string) error {
+	return source.conn.RemoveDirRecur(remotePath)
+}
+
+// SetTime changes the modification time of a remote file using the
+// MFMT command, or MDTM if the server allows writing with it.
+func (source *ftpSource) SetTime(remotePath string, t time.Time) error {
+	if !source.conn.IsSetTimeSupported() {
+		return errSetTimeNotSupported
+	}
+	return source.conn.SetTime(remotePath, t)
+}
+
+// Hash returns the hash of the remote file computed by the server using
+// the HASH, XSHA256, XSHA1, XMD5 or XCRC commands.
+func (source *ftpSource) Hash(remotePath string) (string, string, error) {
+	if source.hashConn == nil && source.hashErr == nil {
+		source.hashConn, source.hashErr = source.dialHash()
+	}
+	if source.hashErr != nil {
+		return "", "", source.hashErr
+	}
+	return source.hashConn.Hash(remotePath)
+}
+
+func (source *ftpSource) NoOp() error {
+	return source.conn.NoOp()
+}
+
+func (source *ftpSource) Close() error {
+	if source.hashConn != nil {
+		source.hashConn.Close()
+	}
+	return source.conn.Quit()
+}
+
+func newFTPRemoteEntry(item *ftp.Entry) *RemoteEntry {
+	return &RemoteEntry{
+		Name:  item.Name,
+		IsDir: item.Type == ftp.EntryTypeFolder,
+		Size:  item.Size,
+		Time:  item.Time,
+	}
+}
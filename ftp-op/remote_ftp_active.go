@@ -0,0 +1,305 @@
+package ftpop
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// ftpActiveConn is the control connection of the active FTP mode. The
+// FTP client library only opens the data connections itself, after a
+// PASV or EPSV command, so each PASV command it sends is replaced by a
+// PORT command announcing a local listener, and the PORT reply by a
+// PASV reply. The data connection "dialed" by the client is then the
+// one opened by the server to the listener (see 'ftpActiveDataConn').
+type ftpActiveConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	// Replies read by the client before the next ones of the server
+	replies bytes.Buffer
+	// Bytes written by the client, up to the end of the current command
+	command []byte
+
+	// Protect the data connections with PBSZ and PROT before the first
+	// PORT, when the explicit TLS upgrade was done before the client got
+	// the connection
+	protectData bool
+
+	// Listener announced by the last PORT command, until a data
+	// connection takes it
+	listener      net.Listener
+	acceptTimeout time.Duration
+	// Set by a 1xx reply: the server opens the data connection
+	transferStarted bool
+}
+
+// newFTPActiveConn wraps the control connection 'conn' for the active
+// mode. With 'explicitTLS', it does the TLS upgrade itself, because the
+// client would upgrade the connection below this one.
+func newFTPActiveConn(conn net.Conn, tlsConfig *tls.Config, explicitTLS bool, acceptTimeout time.Duration) (*ftpActiveConn, error) {
+	activeConn := &ftpActiveConn{Conn: conn, acceptTimeout: acceptTimeout}
+
+	if explicitTLS {
+		text := textproto.NewConn(conn)
+		code, message, err := text.ReadResponse(220)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := text.Cmd("AUTH TLS"); err != nil {
+			return nil, err
+		}
+		if _, _, err := text.ReadResponse(234); err != nil {
+			return nil, err
+		}
+		activeConn.Conn = tls.Client(conn, tlsConfig)
+		activeConn.protectData = true
+		// The client still waits for the greeting
+		activeConn.replies.WriteString(formatFTPReply(code, message))
+	}
+
+	activeConn.reader = bufio.NewReader(activeConn.Conn)
+	return activeConn, nil
+}
+
+// Read returns the server replies one line at a time, to see the 1xx
+// replies of the transfer commands.
+func (conn *ftpActiveConn) Read(b []byte) (int, error) {
+	if conn.replies.Len() == 0 {
+		line, err := conn.reader.ReadString('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		if len(line) > 3 && line[0] == '1' && line[3] == ' ' {
+			conn.transferStarted = true
+		}
+		conn.replies.WriteString(line)
+	}
+	return conn.replies.Read(b)
+}
+
+func (conn *ftpActiveConn) Write(b []byte) (int, error) {
+	conn.command = append(conn.command, b...)
+	for {
+		end := bytes.Index(conn.command, []byte("\r\n")) + 2
+		if end < 2 {
+			return len(b), nil
+		}
+
+		var err error
+		if strings.EqualFold(string(conn.command[:end-2]), "PASV") {
+			err = conn.port()
+		} else {
+			_, err = conn.Conn.Write(conn.command[:end])
+		}
+		conn.command = append(conn.command[:0], conn.command[end:]...)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (conn *ftpActiveConn) Close() error {
+	conn.closeListener()
+	return conn.Conn.Close()
+}
+
+// port replaces a PASV command by a PORT command, or EPRT with IPv6,
+// and gives the client a PASV reply if the server accepts it.
+func (conn *ftpActiveConn) port() error {
+	if conn.protectData {
+		for _, command := range []string{"PBSZ 0", "PROT P"} {
+			if ok, err := conn.cmd(200, command); !ok {
+				return err
+			}
+		}
+		conn.protectData = false
+	}
+
+	// Listen on the address used to reach the server
+	localAddr := conn.LocalAddr().(*net.TCPAddr)
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: localAddr.IP})
+	if err != nil {
+		return err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	command := fmt.Sprintf("EPRT |2|%s|%d|", localAddr.IP, port)
+	if ip := localAddr.IP.To4(); ip != nil {
+		command = fmt.Sprintf("PORT %d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+	}
+	if ok, err := conn.cmd(200, command); !ok {
+		listener.Close()
+		return err
+	}
+
+	conn.closeListener()
+	conn.listener = listener
+	conn.transferStarted = false
+	// The client doesn't dial this address, 'dataConn' takes the listener
+	fmt.Fprintf(&conn.replies, "227 Entering Passive Mode (127,0,0,1,%d,%d).\r\n", port>>8, port&0xff)
+	return nil
+}
+
+// cmd sends a command of its own and reads the reply. An unexpected
+// reply is given to the client instead of the reply to its command, so
+// it fails with the server message.
+func (conn *ftpActiveConn) cmd(expectCode int, command string) (bool, error) {
+	if _, err := fmt.Fprintf(conn.Conn, "%s\r\n", command); err != nil {
+		return false, err
+	}
+
+	code, message, err := textproto.NewReader(conn.reader).ReadResponse(expectCode)
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		conn.replies.WriteString(formatFTPReply(code, message))
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// dataConn returns the data connection of the last PORT command, with
+// 'timeout' like 'deadlineConn'.
+func (conn *ftpActiveConn) dataConn(timeout time.Duration) (net.Conn, error) {
+	if conn.listener == nil {
+		return nil, errors.New("no PORT command before the data connection")
+	}
+
+	dataConn := &ftpActiveDataConn{control: conn, listener: conn.listener, timeout: timeout}
+	conn.listener = nil
+	return dataConn, nil
+}
+
+func (conn *ftpActiveConn) closeListener() {
+	if conn.listener != nil {
+		conn.listener.Close()
+		conn.listener = nil
+	}
+}
+
+// ftpActiveDataConn is a data connection of the active FTP mode. The
+// server only connects after the transfer command, that the client
+// sends once it "dialed" the data connection, so the connection is
+// accepted by its first use.
+type ftpActiveDataConn struct {
+	net.Conn // nil until accepted
+	err      error
+
+	control  *ftpActiveConn
+	listener net.Listener
+	timeout  time.Duration
+}
+
+func (conn *ftpActiveDataConn) accept() error {
+	if conn.Conn != nil || conn.err != nil {
+		return conn.err
+	}
+
+	defer conn.listener.Close()
+	if conn.control.acceptTimeout > 0 {
+		conn.listener.(*net.TCPListener).SetDeadline(time.Now().Add(conn.control.acceptTimeout))
+	}
+	netConn, err := conn.listener.Accept()
+	if err != nil {
+		conn.err = err
+		return err
+	}
+
+	// Only the server can open the data connection
+	serverIP := conn.control.RemoteAddr().(*net.TCPAddr).IP
+	if !netConn.RemoteAddr().(*net.TCPAddr).IP.Equal(serverIP) {
+		netConn.Close()
+		conn.err = fmt.Errorf("data connection from %s instead of the server %s", netConn.RemoteAddr(), serverIP)
+		return conn.err
+	}
+
+	conn.Conn = &deadlineConn{Conn: netConn, timeout: conn.timeout}
+	return nil
+}
+
+func (conn *ftpActiveDataConn) Read(b []byte) (int, error) {
+	if err := conn.accept(); err != nil {
+		return 0, err
+	}
+	return conn.Conn.Read(b)
+}
+
+func (conn *ftpActiveDataConn) Write(b []byte) (int, error) {
+	if err := conn.accept(); err != nil {
+		return 0, err
+	}
+	return conn.Conn.Write(b)
+}
+
+func (conn *ftpActiveDataConn) Close() error {
+	// The server connects once the transfer started, even if the client
+	// doesn't use the connection, like for an empty file
+	if conn.control.transferStarted {
+		conn.accept()
+	}
+
+	if conn.Conn != nil {
+		return conn.Conn.Close()
+	}
+	if conn.err == nil {
+		conn.err = net.ErrClosed
+		return conn.listener.Close()
+	}
+	return nil
+}
+
+func (conn *ftpActiveDataConn) LocalAddr() net.Addr {
+	if conn.Conn == nil {
+		return conn.listener.Addr()
+	}
+	return conn.Conn.LocalAddr()
+}
+
+func (conn *ftpActiveDataConn) RemoteAddr() net.Addr {
+	if conn.Conn == nil {
+		return conn.control.RemoteAddr()
+	}
+	return conn.Conn.RemoteAddr()
+}
+
+func (conn *ftpActiveDataConn) SetDeadline(t time.Time) error {
+	if err := conn.accept(); err != nil {
+		return err
+	}
+	return conn.Conn.SetDeadline(t)
+}
+
+func (conn *ftpActiveDataConn) SetReadDeadline(t time.Time) error {
+	if err := conn.accept(); err != nil {
+		return err
+	}
+	return conn.Conn.SetReadDeadline(t)
+}
+
+func (conn *ftpActiveDataConn) SetWriteDeadline(t time.Time) error {
+	if err := conn.accept(); err != nil {
+		return err
+	}
+	return conn.Conn.SetWriteDeadline(t)
+}
+
+// formatFTPReply formats a reply read by 'textproto', that joins the
+// lines of a multi-line reply with '\n'.
+func formatFTPReply(code int, message string) string {
+	lines := strings.Split(message, "\n")
+	var reply strings.Builder
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		fmt.Fprintf(&reply, "%d%s%s\r\n", code, separator, line)
+	}
+	return reply.String()
+}
@@ -0,0 +1,120 @@
+package ftpop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialFakeFTPServer returns an active mode control connection to a
+// server running 'serve' with its side of the connection, and the client
+// reading and writing it.
+func dialFakeFTPServer(t *testing.T, serve func(server *textproto.Conn) error) (*ftpActiveConn, *textproto.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		server := textproto.NewConn(conn)
+		defer server.Close()
+		done <- serve(server)
+	}()
+	t.Cleanup(func() {
+		if err := <-done; err != nil {
+			t.Errorf("server: %v", err)
+		}
+	})
+
+	netConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeConn, err := newFTPActiveConn(netConn, nil, false, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := textproto.NewConn(activeConn)
+	t.Cleanup(func() { client.Close() })
+	return activeConn, client
+}
+
+func TestFTPActiveConn(t *testing.T) {
+	activeConn, client := dialFakeFTPServer(t, func(server *textproto.Conn) error {
+		line, err := server.ReadLine()
+		if err != nil {
+			return err
+		}
+		var h1, h2, h3, h4, p1, p2 int
+		if _, err := fmt.Sscanf(line, "PORT %d,%d,%d,%d,%d,%d", &h1, &h2, &h3, &h4, &p1, &p2); err != nil {
+			return fmt.Errorf("got %q, want PORT", line)
+		}
+		server.PrintfLine("200 PORT command successful")
+
+		if line, err = server.ReadLine(); err != nil || line != "RETR a.txt" {
+			return fmt.Errorf("got %q %v, want RETR", line, err)
+		}
+		server.PrintfLine("150 Opening data connection")
+		dataConn, err := net.Dial("tcp", fmt.Sprintf("%d.%d.%d.%d:%d", h1, h2, h3, h4, p1<<8+p2))
+		if err != nil {
+			return err
+		}
+		io.WriteString(dataConn, "content")
+		dataConn.Close()
+		return server.PrintfLine("226 Transfer complete")
+	})
+
+	client.PrintfLine("PASV")
+	if _, _, err := client.ReadResponse(227); err != nil {
+		t.Fatal(err)
+	}
+	dataConn, err := activeConn.dataConn(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dataConn.Close()
+
+	// The server connects after the transfer command
+	client.PrintfLine("RETR a.txt")
+	if _, _, err := client.ReadResponse(150); err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(dataConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "content" {
+		t.Errorf("got %q, want %q", content, "content")
+	}
+	if _, _, err := client.ReadResponse(226); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFTPActiveConnPortRefused(t *testing.T) {
+	_, client := dialFakeFTPServer(t, func(server *textproto.Conn) error {
+		if line, err := server.ReadLine(); err != nil || !strings.HasPrefix(line, "PORT ") {
+			return fmt.Errorf("got %q %v, want PORT", line, err)
+		}
+		return server.PrintfLine("500 PORT disabled")
+	})
+
+	client.PrintfLine("PASV")
+	_, _, err := client.ReadResponse(227)
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 500 {
+		t.Errorf("got %v, want the PORT reply", err)
+	}
+}
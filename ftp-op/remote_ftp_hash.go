@@ -0,0 +1,200 @@
+package ftpop
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// errHashNotSupported is returned by 'Hash' when the server doesn't
+// advertise any hash command in FEAT.
+var errHashNotSupported = errors.New("server doesn't support hash commands")
+
+// ftpHashCommands are the hash commands in order of preference, with
+// the algorithm used by each one ('getHashFromFile' names).
+var ftpHashCommands = []struct {
+	feature   string
+	algorithm string
+}{
+	{"XSHA256", "sha256"},
+	{"XSHA1", "sha1"},
+	{"XMD5", "md5"},
+	{"XCRC", "crc32"},
+}
+
+// ftpHashAlgorithms are the algorithms of the 'HASH' command in order
+// of preference, with the names used by 'getHashFromFile'.
+var ftpHashAlgorithms = []struct {
+	name      string
+	algorithm string
+}{
+	{"SHA-256", "sha256"},
+	{"SHA-1", "sha1"},
+	{"MD5", "md5"},
+	{"CRC32", "crc32"},
+}
+
+// ftpHashConn is a second control connection used to send the hash
+// commands, because the FTP client library doesn't support them.
+type ftpHashConn struct {
+	conn      *textproto.Conn
+	command   string
+	algorithm string
+}
+
+// dialFTPHash opens the hash control connection, logs in and chooses
+// the best hash command advertised by the server.
+func (context *ServerContext) dialFTPHash() (*ftpHashConn, error) {
+	hostFullAddress := net.JoinHostPort(context.hostAddress, strconv.Itoa(context.hostPort))
+
+	netConn, err := net.DialTimeout("tcp", hostFullAddress, context.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	// The read timeout includes the time the server takes to hash a file
+	netConn = &deadlineConn{Conn: netConn, timeout: context.readTimeout}
+
+	tlsConfig, err := context.tlsConfig()
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	if context.tlsMode == tlsModeImplicit {
+		netConn = tls.Client(netConn, tlsConfig)
+	}
+
+	hashConn := &ftpHashConn{conn: textproto.NewConn(netConn)}
+	if _, _, err := hashConn.conn.ReadResponse(220); err != nil {
+		hashConn.conn.Close()
+		return nil, err
+	}
+
+	// Upgrade to TLS before sending the credentials
+	if context.tlsMode == tlsModeExplicit {
+		if _, err := hashConn.cmd(234, "AUTH TLS"); err != nil {
+			hashConn.conn.Close()
+			return nil, err
+		}
+		hashConn.conn = textproto.NewConn(tls.Client(netConn, tlsConfig))
+	}
+
+	// Login
+	code, _, err := hashConn.cmdCode(0, "USER %s", context.hostUser)
+	if err == nil && code == 331 {
+		_, err = hashConn.cmd(230, "PASS %s", context.hostPassword)
+	} else if err == nil && code != 230 {
+		err = fmt.Errorf("unexpected USER response code %d", code)
+	}
+	if err != nil {
+		hashConn.conn.Close()
+		return nil, err
+	}
+
+	// Choose the hash command
+	features, err := hashConn.cmd(211, "FEAT")
+	if err != nil {
+		hashConn.Close()
+		return nil, err
+	}
+	if err := hashConn.chooseCommand(features); err != nil {
+		hashConn.Close()
+		return nil, err
+	}
+
+	return hashConn, nil
+}
+
+// chooseCommand selects the hash command from the FEAT response
+func (hashConn *ftpHashConn) chooseCommand(features string) error {
+	advertised := map[string]string{}
+	for _, line := range strings.Split(features, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		advertised[strings.ToUpper(fields[0])] = strings.Join(fields[1:], " ")
+	}
+
+	// 'HASH' lists its algorithms, like 'HASH SHA-256;SHA-1*;MD5'
+	if algorithms, ok := advertised["HASH"]; ok {
+		names := strings.Split(strings.ToUpper(strings.ReplaceAll(algorithms, "*", "")), ";")
+		for _, candidate := range ftpHashAlgorithms {
+			for _, name := range names {
+				if strings.TrimSpace(name) != candidate.name {
+					continue
+				}
+				if _, err := hashConn.cmd(200, "OPTS HASH %s", candidate.name); err != nil {
+					return err
+				}
+				hashConn.command = "HASH"
+				hashConn.algorithm = candidate.algorithm
+				return nil
+			}
+		}
+	}
+
+	for _, candidate := range ftpHashCommands {
+		if _, ok := advertised[candidate.feature]; ok {
+			hashConn.command = candidate.feature
+			hashConn.algorithm = candidate.algorithm
+			return nil
+		}
+	}
+
+	return errHashNotSupported
+}
+
+// Hash returns the algorithm and the hex encoded hash of a remote file
+func (hashConn *ftpHashConn) Hash(remotePath string) (string, string, error) {
+	msg, err := hashConn.cmd(2, "%s %s", hashConn.command, remotePath)
+	if err != nil {
+		return "", "", err
+	}
+
+	fields := strings.Fields(msg)
+	if hashConn.command == "HASH" {
+		// <algorithm> <byte range> <hash> <path>
+		if len(fields) < 3 {
+			return "", "", fmt.Errorf("invalid HASH response '%s'", msg)
+		}
+		return hashConn.algorithm, strings.ToLower(fields[2]), nil
+	}
+
+	// The X* commands only return the hash, some servers add the path
+	if len(fields) < 1 {
+		return "", "", fmt.Errorf("invalid %s response '%s'", hashConn.command, msg)
+	}
+	hash := strings.ToLower(fields[0])
+	if hashConn.algorithm == "crc32" {
+		// Some servers don't pad the CRC with zeros
+		if len(hash) < 8 {
+			hash = strings.Repeat("0", 8-len(hash)) + hash
+		}
+	}
+	return hashConn.algorithm, hash, nil
+}
+
+// Close ends the hash control connection
+func (hashConn *ftpHashConn) Close() error {
+	hashConn.cmd(221, "QUIT")
+	return hashConn.conn.Close()
+}
+
+func (hashConn *ftpHashConn) cmd(expectCode int, format string, args ...interface{}) (string, error) {
+	_, msg, err := hashConn.cmdCode(expectCode, format, args...)
+	return msg, err
+}
+
+func (hashConn *ftpHashConn) cmdCode(expectCode int, format string, args ...interface{}) (int, string, error) {
+	id, err := hashConn.conn.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	hashConn.conn.StartResponse(id)
+	defer hashConn.conn.EndResponse(id)
+	return hashConn.conn.ReadResponse(expectCode)
+}
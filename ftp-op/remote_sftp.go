@@ -0,0 +1,196 @@
+package ftpop
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpSource is the 'RemoteSource' implementation for SSH servers
+type sftpSource struct {
+	sshClient  *ssh.Client
+	sftpClient *sftp.Client
+}
+
+func (context *ServerContext) dialSFTP() (RemoteSource, error) {
+	hostFullAddress := fmt.Sprintf("%s:%d", context.hostAddress, context.hostPort)
+
+	config, err := context.sshClientConfig()
+	if err != nil {
+		return nil, newError(ErrConfig, "dialSFTP", context.ConfigFilePath, err)
+	}
+
+	sshClient, err := ssh.Dial("tcp", hostFullAddress, config)
+	if err != nil {
+		return nil, newError(ErrConnection, "dialSFTP", hostFullAddress, err)
+	}
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, newError(ErrConnection, "dialSFTP", hostFullAddress, err)
+	}
+
+	return &sftpSource{sshClient: sshClient, sftpClient: sftpClient}, nil
+}
+
+// sshClientConfig returns the SSH authentication and host key
+// verification settings from the config file.
+func (context *ServerContext) sshClientConfig() (*ssh.ClientConfig, error) {
+	var authMethods []ssh.AuthMethod
+
+	// Private key
+	if context.sshPrivateKeyFile != "" {
+		pem, err := ioutil.ReadFile(context.sshPrivateKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		if context.sshPrivateKeyPassphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(context.sshPrivateKeyPassphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pem)
+		}
+		if err != nil {
+			return nil, err
+		}
+		authMethods = append(authMethods, ssh.PublicKeys(signer))
+	}
+
+	// Password
+	if context.hostPassword != "" {
+		authMethods = append(authMethods, ssh.Password(context.hostPassword))
+	}
+
+	// Host key verification
+	var hostKeyCallback ssh.HostKeyCallback
+	if context.sshInsecureIgnoreHostKey {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	} else {
+		knownHostsFile := context.sshKnownHostsFile
+		if knownHostsFile == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+		}
+		callback, err := knownhosts.New(knownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+		hostKeyCallback = callback
+	}
+
+	return &ssh.ClientConfig{
+		User:            context.hostUser,
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         context.dialTimeout,
+	}, nil
+}
+
+func (source *sftpSource) List(remotePath string) ([]*RemoteEntry, error) {
+	items, err := source.sftpClient.ReadDir(remotePath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*RemoteEntry, 0, len(items))
+	for _, item := range items {
+		if isSpecialDirName(item.Name()) {
+			continue
+		}
+		entries = append(entries, newSFTPRemoteEntry(item))
+	}
+	return entries, nil
+}
+
+func (source *sftpSource) Retrieve(remotePath string, offset uint64) (io.ReadCloser, error) {
+	file, err := source.sftpClient.Open(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		if _, err := file.Seek(int64(offset), io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+func (source *sftpSource) Stat(remotePath string) (*RemoteEntry, error) {
+	item, err := source.sftpClient.Stat(remotePath)
+	if err != nil {
+		return nil, err
+	}
+	return newSFTPRemoteEntry(item), nil
+}
+
+func (source *sftpSource) Store(remotePath string, r io.Reader) error {
+	file, err := source.sftpClient.Create(remotePath)
+	if err != nil {
+		return err
+	}
+	_, err = file.ReadFrom(r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (source *sftpSource) Rename(from string, to string) error {
+	// Plain SFTP rename fails if 'to' exists
+	return source.sftpClient.PosixRename(from, to)
+}
+
+func (source *sftpSource) MakeDir(remotePath string) error {
+	return source.sftpClient.Mkdir(remotePath)
+}
+
+func (source *sftpSource) Remove(remotePath string) error {
+	return source.sftpClient.Remove(remotePath)
+}
+
+func (source *sftpSource) RemoveDir(remotePath string) error {
+	return source.sftpClient.RemoveAll(remotePath)
+}
+
+func (source *sftpSource) SetTime(remotePath string, t time.Time) error {
+	return source.sftpClient.Chtimes(remotePath, t, t)
+}
+
+// NoOp asks the current directory, SFTP doesn't have a NOOP request
+func (source *sftpSource) NoOp() error {
+	_, err := source.sftpClient.Getwd()
+	return err
+}
+
+func (source *sftpSource) Close() error {
+	err := source.sftpClient.Close()
+	if sshErr := source.sshClient.Close(); err == nil {
+		err = sshErr
+	}
+	return err
+}
+
+func newSFTPRemoteEntry(item os.FileInfo) *RemoteEntry {
+	var size uint64
+	if !item.IsDir() {
+		size = uint64(item.Size())
+	}
+	return &RemoteEntry{
+		Name:  item.Name(),
+		IsDir: item.IsDir(),
+		Size:  size,
+		Time:  item.ModTime(),
+	}
+}
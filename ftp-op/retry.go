@@ -0,0 +1,218 @@
+package ftpop
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// retry calls 'fn' until it succeeds or fails with a permanent error, at
+// most 'retryMaxAttempts' times. The delay between the attempts starts
+// at 'retryDelay' and doubles up to 'retryMaxDelay'.
+func (context *ServerContext) retry(op string, path string, fn func() error) error {
+	delay := context.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || !isTransientError(err) || attempt >= context.retryMaxAttempts {
+			return err
+		}
+
+		context.logger().Warn("Retrying", "op", op, "path", path,
+			"attempt", attempt, "delay", delay, "error", err)
+		time.Sleep(delay)
+		delay = min(2*delay, context.retryMaxDelay)
+	}
+}
+
+// isTransientError returns 'true' for the errors that may not happen
+// again, like a dropped connection, a timeout or a FTP 4xx reply
+func isTransientError(err error) bool {
+	var protocolErr *textproto.Error
+	if errors.As(err, &protocolErr) {
+		return protocolErr.Code >= 400 && protocolErr.Code < 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, sftp.ErrSSHFxConnectionLost) ||
+		errors.Is(err, sftp.ErrSSHFxNoConnection)
+}
+
+// retrySource is the 'RemoteSource' returned by 'dialRemote'. It retries
+// the operations that failed with a transient error, reconnecting first
+// if the connection was dropped.
+// 'Retrieve' and 'Store' aren't retried here since a failed transfer must
+// restart from the partial file, 'retryTransfer' retries the whole
+// download or upload instead.
+type retrySource struct {
+	context *ServerContext
+	source  RemoteSource
+
+	// broken is set after a transient error, the connection is checked
+	// before the next operation
+	broken bool
+	// retrying avoids nested retries when an operation retried by
+	// 'retryTransfer' fails
+	retrying bool
+}
+
+// dialRemote connects to the remote server, retrying the transient
+// errors, and returns a 'retrySource'
+func (context *ServerContext) dialRemote() (RemoteSource, error) {
+	var source RemoteSource
+	err := context.retry("dialRemote", context.hostAddress, func() error {
+		var err error
+		source, err = context.dialProtocol()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &retrySource{context: context, source: source}, nil
+}
+
+// do runs an operation on the current connection with retries
+func (source *retrySource) do(op string, path string, fn func(remote RemoteSource) error) error {
+	if source.retrying {
+		return fn(source.source)
+	}
+	source.retrying = true
+	defer func() { source.retrying = false }()
+
+	return source.context.retry(op, path, func() error {
+		if source.broken {
+			if err := source.reconnect(); err != nil {
+				return err
+			}
+		}
+		err := fn(source.source)
+		source.broken = err != nil && isTransientError(err)
+		return err
+	})
+}
+
+// reconnect logs in again if the connection doesn't answer a NOOP
+func (source *retrySource) reconnect() error {
+	if pinger, ok := source.source.(remotePinger); ok && pinger.NoOp() == nil {
+		source.broken = false
+		return nil
+	}
+
+	source.source.Close()
+	fresh, err := source.context.dialProtocol()
+	if err != nil {
+		return err
+	}
+	source.source = fresh
+	source.broken = false
+	source.context.logger().Info("Reconnected to remote server")
+	return nil
+}
+
+// retryTransfer retries a whole download or upload with the connection
+// of 'remote'
+func (context *ServerContext) retryTransfer(remote RemoteSource, op string, path string, fn func() error) error {
+	source, ok := remote.(*retrySource)
+	if !ok {
+		return fn()
+	}
+	return source.do(op, path, func(RemoteSource) error {
+		return fn()
+	})
+}
+
+func (source *retrySource) List(path string) ([]*RemoteEntry, error) {
+	var entries []*RemoteEntry
+	err := source.do("List", path, func(remote RemoteSource) error {
+		var err error
+		entries, err = remote.List(path)
+		return err
+	})
+	return entries, err
+}
+
+func (source *retrySource) Retrieve(path string, offset uint64) (io.ReadCloser, error) {
+	return source.source.Retrieve(path, offset)
+}
+
+func (source *retrySource) Stat(path string) (*RemoteEntry, error) {
+	var entry *RemoteEntry
+	err := source.do("Stat", path, func(remote RemoteSource) error {
+		var err error
+		entry, err = remote.Stat(path)
+		return err
+	})
+	return entry, err
+}
+
+func (source *retrySource) Store(path string, r io.Reader) error {
+	return source.source.Store(path, r)
+}
+
+func (source *retrySource) Rename(from string, to string) error {
+	return source.do("Rename", from, func(remote RemoteSource) error {
+		return remote.Rename(from, to)
+	})
+}
+
+func (source *retrySource) MakeDir(path string) error {
+	return source.do("MakeDir", path, func(remote RemoteSource) error {
+		return remote.MakeDir(path)
+	})
+}
+
+func (source *retrySource) Remove(path string) error {
+	return source.do("Remove", path, func(remote RemoteSource) error {
+		return remote.Remove(path)
+	})
+}
+
+func (source *retrySource) RemoveDir(path string) error {
+	return source.do("RemoveDir", path, func(remote RemoteSource) error {
+		return remote.RemoveDir(path)
+	})
+}
+
+func (source *retrySource) SetTime(path string, t time.Time) error {
+	return source.do("SetTime", path, func(remote RemoteSource) error {
+		setter, ok := remote.(remoteTimeSetter)
+		if !ok {
+			return errSetTimeNotSupported
+		}
+		return setter.SetTime(path, t)
+	})
+}
+
+// Hash isn't retried, 'hashHasChange' uses the state database if the
+// server can't compute the hash
+func (source *retrySource) Hash(path string) (string, string, error) {
+	hasher, ok := source.source.(remoteHasher)
+	if !ok {
+		return "", "", errHashNotSupported
+	}
+	return hasher.Hash(path)
+}
+
+// NoOp isn't retried, it's used to check the connection
+func (source *retrySource) NoOp() error {
+	pinger, ok := source.source.(remotePinger)
+	if !ok {
+		return nil
+	}
+	return pinger.NoOp()
+}
+
+func (source *retrySource) Close() error {
+	return source.source.Close()
+}
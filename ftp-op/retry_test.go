@@ -0,0 +1,64 @@
+package ftpop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// timeoutError is a 'net.Error' like the ones of the deadlines
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil", err: nil, want: false},
+		{name: "FTP 421", err: &textproto.Error{Code: 421, Msg: "Service not available"}, want: true},
+		{name: "FTP 425", err: &textproto.Error{Code: 425, Msg: "Can't open data connection"}, want: true},
+		{name: "FTP 450", err: &textproto.Error{Code: 450, Msg: "File unavailable"}, want: true},
+		{name: "FTP 500", err: &textproto.Error{Code: 500, Msg: "Syntax error"}, want: false},
+		{name: "FTP 530", err: &textproto.Error{Code: 530, Msg: "Not logged in"}, want: false},
+		{name: "FTP 550", err: &textproto.Error{Code: 550, Msg: "File not found"}, want: false},
+		{name: "FTP 3xx", err: &textproto.Error{Code: 350, Msg: "Pending"}, want: false},
+		{name: "wrapped FTP 421", err: newError(ErrDownload, "Retrieve", "/a", &textproto.Error{Code: 421}), want: true},
+		{name: "wrapped FTP 550", err: fmt.Errorf("retrieve: %w", &textproto.Error{Code: 550}), want: false},
+		{name: "timeout", err: timeoutError{}, want: true},
+		{name: "wrapped timeout", err: &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, want: true},
+		{name: "EOF", err: io.EOF, want: true},
+		{name: "unexpected EOF", err: io.ErrUnexpectedEOF, want: true},
+		{name: "wrapped EOF", err: fmt.Errorf("read reply: %w", io.EOF), want: true},
+		{name: "closed connection", err: net.ErrClosed, want: true},
+		{name: "connection reset", err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}, want: true},
+		{name: "connection refused", err: syscall.ECONNREFUSED, want: true},
+		{name: "broken pipe", err: syscall.EPIPE, want: true},
+		{name: "SFTP connection lost", err: sftp.ErrSSHFxConnectionLost, want: true},
+		{name: "SFTP no connection", err: sftp.ErrSSHFxNoConnection, want: true},
+		{name: "not found", err: os.ErrNotExist, want: false},
+		{name: "wrapped not found", err: &os.PathError{Op: "stat", Path: "/a", Err: os.ErrNotExist}, want: false},
+		{name: "permission denied", err: os.ErrPermission, want: false},
+		{name: "SFTP permission denied", err: sftp.ErrSSHFxPermissionDenied, want: false},
+		{name: "other error", err: errors.New("invalid listing"), want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isTransientError(test.err); got != test.want {
+				t.Errorf("isTransientError(%v): got %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
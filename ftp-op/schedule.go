@@ -0,0 +1,45 @@
+package ftpop
+
+import (
+	"errors"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// schedule reads the 'schedule' cron expression or the 'interval'
+// duration of the daemon runs. Returns nil if none is set.
+func (reader *configReader) schedule() cron.Schedule {
+	scheduleIsSet := reader.isSet("schedule")
+	intervalIsSet := reader.isSet("interval")
+
+	switch {
+	case scheduleIsSet && intervalIsSet:
+		reader.problem("'schedule' and 'interval' can't be set together")
+	case scheduleIsSet:
+		schedule, err := cron.ParseStandard(reader.str("schedule"))
+		if err != nil {
+			reader.problem("invalid 'schedule' value '%v' (%v)", reader.config.Get("schedule"), err)
+			return nil
+		}
+		return schedule
+	case intervalIsSet:
+		interval, err := time.ParseDuration(reader.str("interval"))
+		if err != nil || interval < time.Second {
+			reader.problem("invalid 'interval' value '%v' (expected a duration of 1s or more, like '15m')", reader.config.Get("interval"))
+			return nil
+		}
+		return cron.Every(interval)
+	}
+	return nil
+}
+
+// NextRun returns the time of the first daemon run after 'after', using
+// the 'schedule' or 'interval' of the job. It needs 'Open' or 'Connect'.
+func (context *ServerContext) NextRun(after time.Time) (time.Time, error) {
+	if context.schedule == nil {
+		return time.Time{}, newError(ErrConfig, "NextRun", context.ConfigFilePath,
+			errors.New("'schedule' or 'interval' not found in config file"))
+	}
+	return context.schedule.Next(after), nil
+}
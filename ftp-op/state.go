@@ -0,0 +1,291 @@
+package ftpop
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// State database buckets. All keys are paths relative to 'syncLocalDir',
+// which are the same as the paths relative to 'syncRemoteDir'.
+var (
+	// stateBucketFiles holds a 'fileState' for each downloaded file
+	stateBucketFiles = []byte("files")
+	// stateBucketPartials holds a 'partialState' for each partial download
+	stateBucketPartials = []byte("partials")
+	// stateBucketCompressed holds a 'compressState' for each compressed file
+	stateBucketCompressed = []byte("compressed")
+)
+
+// stateDB is the persistent state of the sync and compress runs, stored
+// in a BoltDB file next to 'syncLocalDir'. A nil '*stateDB' is valid and
+// stores nothing, it's used in dry-run mode before the first run.
+type stateDB struct {
+	db *bolt.DB
+}
+
+// fileState is the remote version, local modification time and content
+// hash of a synced file
+type fileState struct {
+	Size         uint64    `json:"size"`
+	Time         time.Time `json:"time"`
+	LocalTime    time.Time `json:"localTime"`
+	Hash         string    `json:"sha1"`
+	DownloadedAt time.Time `json:"downloadedAt"`
+	UploadedAt   time.Time `json:"uploadedAt"`
+}
+
+// partialState is the remote version a partial file was downloaded from
+type partialState struct {
+	Size      uint64    `json:"size"`
+	Time      time.Time `json:"time"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+// compressState is the hash of a file when it was compressed and the
+// hash of the resulting zip file
+type compressState struct {
+	Hash           string    `json:"sha1"`
+	CompressedHash string    `json:"compressedSha1"`
+	CompressedAt   time.Time `json:"compressedAt"`
+}
+
+// openState opens the state database. In dry-run mode it's opened read
+// only, if it exists.
+func (context *ServerContext) openState() error {
+	path := context.stateFilePath
+
+	if context.DryRun {
+		if !fileExists(path) {
+			return nil
+		}
+	} else if err := ensureDirExist(filepath.Dir(path)); err != nil {
+		return newError(ErrConfig, "openState", path, err)
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: context.DryRun})
+	if err == bolt.ErrTimeout {
+		err = errors.New("state database is locked by another run")
+	}
+	if err != nil {
+		return newError(ErrConfig, "openState", path, err)
+	}
+
+	if !context.DryRun {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, bucket := range [][]byte{stateBucketFiles, stateBucketPartials, stateBucketCompressed} {
+				if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return newError(ErrConfig, "openState", path, err)
+		}
+	}
+
+	context.state = &stateDB{db: db}
+	return nil
+}
+
+// closeState closes the state database
+func (context *ServerContext) closeState() error {
+	if context.state == nil {
+		return nil
+	}
+	err := context.state.db.Close()
+	context.state = nil
+	return err
+}
+
+// get decodes the value of 'key' into 'value'. Returns 'false' if the
+// key doesn't exist.
+func (state *stateDB) get(bucket []byte, key string, value interface{}) (bool, error) {
+	if state == nil {
+		return false, nil
+	}
+
+	found := false
+	err := state.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, value)
+	})
+	return found, err
+}
+
+func (state *stateDB) put(bucket []byte, key string, value interface{}) error {
+	if state == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return state.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), data)
+	})
+}
+
+func (state *stateDB) delete(bucket []byte, key string) error {
+	if state == nil {
+		return nil
+	}
+
+	return state.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+}
+
+// forEach calls 'fn' for each key of 'bucket' in alphabetical order
+func (state *stateDB) forEach(bucket []byte, fn func(key string, data []byte) error) error {
+	if state == nil {
+		return nil
+	}
+
+	return state.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(key []byte, data []byte) error {
+			return fn(string(key), data)
+		})
+	})
+}
+
+// prune deletes the keys of 'bucket' whose file doesn't exist in 'dir'
+// anymore. 'suffix' is appended to the key to get the file name.
+func (state *stateDB) prune(bucket []byte, dir string, suffix string) error {
+	if state == nil {
+		return nil
+	}
+
+	return state.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		var obsoleteKeys [][]byte
+		err := b.ForEach(func(key []byte, data []byte) error {
+			if !fileExists(filepath.Join(dir, filepath.FromSlash(string(key))+suffix)) {
+				obsoleteKeys = append(obsoleteKeys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range obsoleteKeys {
+			if err := b.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (state *stateDB) getFile(relativeFilePath string) (*fileState, error) {
+	record := &fileState{}
+	found, err := state.get(stateBucketFiles, relativeFilePath, record)
+	if !found || err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (state *stateDB) getPartial(relativeFilePath string) (*partialState, error) {
+	record := &partialState{}
+	found, err := state.get(stateBucketPartials, relativeFilePath, record)
+	if !found || err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (state *stateDB) getCompressed(relativeFilePath string) (*compressState, error) {
+	record := &compressState{}
+	found, err := state.get(stateBucketCompressed, relativeFilePath, record)
+	if !found || err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// hasFilesIn returns 'true' if a file inside 'relativeDir' was synced
+func (state *stateDB) hasFilesIn(relativeDir string) (bool, error) {
+	if state == nil {
+		return false, nil
+	}
+
+	prefix := []byte(relativeDir + "/")
+	found := false
+	err := state.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(stateBucketFiles)
+		if b == nil {
+			return nil
+		}
+		key, _ := b.Cursor().Seek(prefix)
+		found = key != nil && bytes.HasPrefix(key, prefix)
+		return nil
+	})
+	return found, err
+}
+
+// clearPartials deletes the records of all partial downloads
+func (state *stateDB) clearPartials() error {
+	if state == nil {
+		return nil
+	}
+
+	return state.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(stateBucketPartials); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucket(stateBucketPartials)
+		return err
+	})
+}
+
+// defaultStateFilePath returns the path of the state database next to
+// 'syncLocalDir', like '.mirror.state.db' for './mirror'.
+func defaultStateFilePath(syncLocalDir string) (string, error) {
+	absoluteLocalDir, err := filepath.Abs(syncLocalDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(
+		filepath.Dir(absoluteLocalDir),
+		fmt.Sprintf(".%s.state.db", filepath.Base(absoluteLocalDir)),
+	), nil
+}
+
+// localRelativePath returns the state database key of a path inside the
+// local sync directory
+func (context *ServerContext) localRelativePath(localPath string) (string, error) {
+	absoluteLocalDir, err := filepath.Abs(context.syncLocalDir)
+	if err != nil {
+		return "", err
+	}
+	absoluteLocalPath, err := filepath.Abs(localPath)
+	if err != nil {
+		return "", err
+	}
+	relativeLocalPath, err := filepath.Rel(absoluteLocalDir, absoluteLocalPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(relativeLocalPath), nil
+}
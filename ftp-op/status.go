@@ -0,0 +1,75 @@
+package ftpop
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Status summarizes the state database of a job
+type Status struct {
+	// Files is the number of synced files and Bytes their total size
+	Files int
+	Bytes uint64
+	// LastDownload and LastUpload are zero if nothing was transferred
+	LastDownload time.Time
+	LastUpload   time.Time
+
+	// PartialDownloads is the number of interrupted downloads that
+	// will be resumed by the next sync
+	PartialDownloads int
+
+	// Compressed is the number of compressed files
+	Compressed     int
+	LastCompressed time.Time
+}
+
+// Status reads the state database without connecting to the remote
+// server. It needs 'Open' or 'Connect'. The status is empty if the
+// database doesn't exist yet in dry-run mode.
+func (context *ServerContext) Status() (*Status, error) {
+	status := &Status{}
+
+	err := context.state.forEach(stateBucketFiles, func(relativeFilePath string, data []byte) error {
+		record := &fileState{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return err
+		}
+		status.Files++
+		status.Bytes += record.Size
+		if record.DownloadedAt.After(status.LastDownload) {
+			status.LastDownload = record.DownloadedAt
+		}
+		if record.UploadedAt.After(status.LastUpload) {
+			status.LastUpload = record.UploadedAt
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, newError(ErrReport, "Status", context.stateFilePath, err)
+	}
+
+	err = context.state.forEach(stateBucketPartials, func(relativeFilePath string, data []byte) error {
+		status.PartialDownloads++
+		return nil
+	})
+	if err != nil {
+		return nil, newError(ErrReport, "Status", context.stateFilePath, err)
+	}
+
+	err = context.state.forEach(stateBucketCompressed, func(relativeFilePath string, data []byte) error {
+		record := &compressState{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return err
+		}
+		status.Compressed++
+		if record.CompressedAt.After(status.LastCompressed) {
+			status.LastCompressed = record.CompressedAt
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, newError(ErrReport, "Status", context.stateFilePath, err)
+	}
+
+	return status, nil
+}
@@ -0,0 +1,231 @@
+package ftpop
+
+import (
+	stdcontext "context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"golang.org/x/time/rate"
+)
+
+// throttleChunkSize is the largest read of a throttled download, it's
+// also the burst allowed by the limiters
+const throttleChunkSize = 32 * 1024
+
+// RateLimiter limits the speed, in bytes per second, of all the downloads
+// sharing it, like the parallel downloads of a job or all jobs of a
+// config file. The limit can change with the time of day.
+type RateLimiter struct {
+	// limit is used outside of the windows, 0 is unlimited
+	limit   int64
+	windows []rateWindow
+
+	limiter *rate.Limiter
+}
+
+// rateWindow is a daily time range with its own limit. 'from' and 'to'
+// are durations since midnight, the window crosses midnight if 'to' is
+// before 'from'.
+type rateWindow struct {
+	from  time.Duration
+	to    time.Duration
+	limit int64
+}
+
+// NewRateLimiter reads the 'globalDownloadRateLimit' and
+// 'globalDownloadRateLimitSchedule' top-level keys of the config file,
+// which limit all its jobs together. Returns nil if they aren't set.
+func NewRateLimiter(configFilePath string) (*RateLimiter, error) {
+	configFile, err := loadConfigFile(configFilePath)
+	if err != nil {
+		return nil, newError(ErrConfig, "NewRateLimiter", configFilePath, err)
+	}
+	bindEnv(configFile)
+	reader := &configReader{config: configFile}
+
+	limiter := reader.rateLimiter("globalDownloadRateLimit", "globalDownloadRateLimitSchedule")
+	if err := reader.err(); err != nil {
+		return nil, newError(ErrConfig, "NewRateLimiter", configFilePath, err)
+	}
+	return limiter, nil
+}
+
+// limitAt returns the limit at the time of day of 't'
+func (limiter *RateLimiter) limitAt(t time.Time) int64 {
+	timeOfDay := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, window := range limiter.windows {
+		inWindow := timeOfDay >= window.from && timeOfDay < window.to
+		if window.to < window.from {
+			inWindow = timeOfDay >= window.from || timeOfDay < window.to
+		}
+		if inWindow {
+			return window.limit
+		}
+	}
+	return limiter.limit
+}
+
+// waitN blocks until 'n' bytes can be read at the current limit
+func (limiter *RateLimiter) waitN(n int) error {
+	if limiter == nil || n == 0 {
+		return nil
+	}
+
+	newLimit := rate.Inf
+	if limit := limiter.limitAt(time.Now()); limit > 0 {
+		newLimit = rate.Limit(limit)
+	}
+	if limiter.limiter.Limit() != newLimit {
+		limiter.limiter.SetLimit(newLimit)
+	}
+	if newLimit == rate.Inf {
+		return nil
+	}
+	return limiter.limiter.WaitN(stdcontext.Background(), n)
+}
+
+// throttledReader reads in chunks no larger than the burst of the
+// limiters and waits for all of them after each chunk
+type throttledReader struct {
+	io.ReadCloser
+	limiters []*RateLimiter
+}
+
+func (reader *throttledReader) Read(b []byte) (int, error) {
+	if len(b) > throttleChunkSize {
+		b = b[:throttleChunkSize]
+	}
+	n, err := reader.ReadCloser.Read(b)
+	for _, limiter := range reader.limiters {
+		if waitErr := limiter.waitN(n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// throttle limits the speed of a download with the limiter of the job
+// and 'GlobalRateLimiter'
+func (context *ServerContext) throttle(reader io.ReadCloser) io.ReadCloser {
+	var limiters []*RateLimiter
+	for _, limiter := range []*RateLimiter{context.downloadRateLimiter, context.GlobalRateLimiter} {
+		if limiter != nil {
+			limiters = append(limiters, limiter)
+		}
+	}
+	if len(limiters) == 0 {
+		return reader
+	}
+	return &throttledReader{ReadCloser: reader, limiters: limiters}
+}
+
+// rateLimiter reads a limit and its schedule, like:
+//
+//	downloadRateLimit: 0
+//	downloadRateLimitSchedule:
+//	  - from: "08:00"
+//	    to: "18:00"
+//	    limit: 2MB
+//
+// Returns nil if no limit is set.
+func (reader *configReader) rateLimiter(limitKey string, scheduleKey string) *RateLimiter {
+	limiter := &RateLimiter{}
+	if reader.isSet(limitKey) {
+		limiter.limit = reader.byteSize(limitKey)
+	}
+
+	if reader.isSet(scheduleKey) {
+		items, err := cast.ToSliceE(reader.config.Get(scheduleKey))
+		if err != nil {
+			reader.problem("invalid '%s' value (expected a list of 'from', 'to' and 'limit')", scheduleKey)
+		}
+		for i, item := range items {
+			window, err := parseRateWindow(item)
+			if err != nil {
+				reader.problem("invalid '%s' item %d: %v", scheduleKey, i+1, err)
+				continue
+			}
+			limiter.windows = append(limiter.windows, window)
+		}
+	}
+
+	// Unlimited all day
+	if limiter.limit == 0 && len(limiter.windows) == 0 {
+		return nil
+	}
+	limiter.limiter = rate.NewLimiter(rate.Inf, throttleChunkSize)
+	return limiter
+}
+
+// byteSize returns the size of 'key', like '2MB'
+func (reader *configReader) byteSize(key string) int64 {
+	size, err := parseByteSize(reader.str(key))
+	if err != nil {
+		reader.problem("invalid '%s' value '%v' (%v)", key, reader.config.Get(key), err)
+	}
+	return size
+}
+
+func parseRateWindow(item interface{}) (rateWindow, error) {
+	fields, err := cast.ToStringMapStringE(item)
+	if err != nil {
+		return rateWindow{}, fmt.Errorf("expected 'from', 'to' and 'limit'")
+	}
+
+	window := rateWindow{}
+	if window.from, err = parseTimeOfDay(fields["from"]); err != nil {
+		return window, fmt.Errorf("invalid 'from': %v", err)
+	}
+	if window.to, err = parseTimeOfDay(fields["to"]); err != nil {
+		return window, fmt.Errorf("invalid 'to': %v", err)
+	}
+	if window.limit, err = parseByteSize(fields["limit"]); err != nil {
+		return window, fmt.Errorf("invalid 'limit': %v", err)
+	}
+	return window, nil
+}
+
+// parseTimeOfDay parses a time like '18:30' as a duration since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("expected a time like '18:30', got '%s'", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseByteSize parses a size in bytes, like '512', '64KB', '2MB' or
+// '1GB'. The units are multiples of 1024.
+func parseByteSize(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	value = strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	// Also rejects NaN and infinite values
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || !(number >= 0) || math.IsInf(number, 1) {
+		return 0, fmt.Errorf("expected a size like '512KB' or '2MB'")
+	}
+	return int64(number * float64(multiplier)), nil
+}
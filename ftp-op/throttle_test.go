@@ -0,0 +1,135 @@
+package ftpop
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "0", want: 0},
+		{value: "512", want: 512},
+		{value: "512B", want: 512},
+		{value: "64KB", want: 64 << 10},
+		{value: "2MB", want: 2 << 20},
+		{value: "1GB", want: 1 << 30},
+		{value: "1.5MB", want: 3 << 19},
+		{value: " 2 mb ", want: 2 << 20},
+		{value: "", wantErr: true},
+		{value: "MB", wantErr: true},
+		{value: "fast", wantErr: true},
+		{value: "-1MB", wantErr: true},
+		{value: "2TB", wantErr: true},
+		{value: "inf", wantErr: true},
+		{value: "NaN", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseByteSize(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseByteSize(%q): got %d, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseByteSize(%q): got %d, %v, want %d", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestParseTimeOfDay(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "00:00", want: 0},
+		{value: "08:30", want: 8*time.Hour + 30*time.Minute},
+		{value: "9:05", want: 9*time.Hour + 5*time.Minute},
+		{value: "23:59", want: 23*time.Hour + 59*time.Minute},
+		{value: "", wantErr: true},
+		{value: "24:00", wantErr: true},
+		{value: "12:60", wantErr: true},
+		{value: "18:30:00", wantErr: true},
+		{value: "6pm", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseTimeOfDay(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseTimeOfDay(%q): got %v, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseTimeOfDay(%q): got %v, %v, want %v", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestRateLimiterLimitAt(t *testing.T) {
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+	window := func(from string, to string, limit int64) rateWindow {
+		fromDuration, _ := parseTimeOfDay(from)
+		toDuration, _ := parseTimeOfDay(to)
+		return rateWindow{from: fromDuration, to: toDuration, limit: limit}
+	}
+
+	tests := []struct {
+		name    string
+		limit   int64
+		windows []rateWindow
+		at      time.Time
+		want    int64
+	}{
+		{name: "no window", limit: 100, at: at(12, 0), want: 100},
+		{name: "inside a window", limit: 100, windows: []rateWindow{window("08:00", "18:00", 10)}, at: at(12, 0), want: 10},
+		{name: "window start is included", limit: 100, windows: []rateWindow{window("08:00", "18:00", 10)}, at: at(8, 0), want: 10},
+		{name: "window end is excluded", limit: 100, windows: []rateWindow{window("08:00", "18:00", 10)}, at: at(18, 0), want: 100},
+		{name: "before a window", limit: 100, windows: []rateWindow{window("08:00", "18:00", 10)}, at: at(7, 59), want: 100},
+		{name: "unlimited outside a window", windows: []rateWindow{window("08:00", "18:00", 10)}, at: at(20, 0), want: 0},
+		{name: "wrapping window before midnight", limit: 100, windows: []rateWindow{window("22:00", "06:00", 10)}, at: at(23, 30), want: 10},
+		{name: "wrapping window after midnight", limit: 100, windows: []rateWindow{window("22:00", "06:00", 10)}, at: at(0, 0), want: 10},
+		{name: "wrapping window end is excluded", limit: 100, windows: []rateWindow{window("22:00", "06:00", 10)}, at: at(6, 0), want: 100},
+		{name: "outside a wrapping window", limit: 100, windows: []rateWindow{window("22:00", "06:00", 10)}, at: at(12, 0), want: 100},
+		{name: "empty window", limit: 100, windows: []rateWindow{window("08:00", "08:00", 10)}, at: at(8, 0), want: 100},
+		{
+			name:    "overlapping windows, first match wins",
+			limit:   100,
+			windows: []rateWindow{window("08:00", "18:00", 10), window("12:00", "20:00", 20)},
+			at:      at(13, 0),
+			want:    10,
+		},
+		{
+			name:    "overlapping windows, second window only",
+			limit:   100,
+			windows: []rateWindow{window("08:00", "18:00", 10), window("12:00", "20:00", 20)},
+			at:      at(19, 0),
+			want:    20,
+		},
+		{
+			name:    "overlapping wrapping windows",
+			limit:   100,
+			windows: []rateWindow{window("23:00", "01:00", 10), window("20:00", "06:00", 20)},
+			at:      at(0, 30),
+			want:    10,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := &RateLimiter{limit: test.limit, windows: test.windows}
+			if got := limiter.limitAt(test.at); got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package ftpop
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// FTP data connection modes accepted by the 'ftpMode' config key
+const (
+	// ftpModeEPSV uses EPSV if the server supports it, else PASV
+	ftpModeEPSV    = "epsv"
+	ftpModePassive = "passive"
+	// ftpModeActive sends PORT (EPRT with IPv6), see 'ftpActiveConn'
+	ftpModeActive = "active"
+)
+
+// deadlineConn is a 'net.Conn' whose reads and writes fail if they don't
+// complete in 'timeout', so a server that stops answering can't block a
+// run forever. A zero 'timeout' disables it.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (conn *deadlineConn) Read(b []byte) (int, error) {
+	if conn.timeout > 0 {
+		if err := conn.Conn.SetReadDeadline(time.Now().Add(conn.timeout)); err != nil {
+			return 0, err
+		}
+	}
+	return conn.Conn.Read(b)
+}
+
+func (conn *deadlineConn) Write(b []byte) (int, error) {
+	if conn.timeout > 0 {
+		if err := conn.Conn.SetWriteDeadline(time.Now().Add(conn.timeout)); err != nil {
+			return 0, err
+		}
+	}
+	return conn.Conn.Write(b)
+}
+
+// ftpDialFunc returns the function used by the FTP client to open its
+// connections: the control connection first, with 'readTimeout', then a
+// data connection for each transfer or listing, with 'dataTimeout'.
+// The client doesn't add TLS to the connections of a custom dial
+// function, except the explicit TLS upgrade of the control connection.
+// In active mode, the data connections are accepted from the server.
+func (context *ServerContext) ftpDialFunc(tlsConfig *tls.Config) func(network string, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: context.dialTimeout}
+	isControlConn := true
+	var activeConn *ftpActiveConn
+
+	return func(network string, address string) (net.Conn, error) {
+		var conn net.Conn
+		if isControlConn {
+			isControlConn = false
+			netConn, err := dialer.Dial(network, address)
+			if err != nil {
+				return nil, err
+			}
+			conn = &deadlineConn{Conn: netConn, timeout: context.readTimeout}
+			if context.tlsMode == tlsModeImplicit {
+				conn = tls.Client(conn, tlsConfig)
+			}
+			if context.ftpMode == ftpModeActive {
+				explicitTLS := context.tlsMode == tlsModeExplicit
+				activeConn, err = newFTPActiveConn(conn, tlsConfig, explicitTLS, context.dialTimeout)
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+				conn = activeConn
+			}
+			return conn, nil
+		}
+
+		if activeConn != nil {
+			// 'address' is the one of the PASV reply made up for the client
+			dataConn, err := activeConn.dataConn(context.dataTimeout)
+			if err != nil {
+				return nil, err
+			}
+			conn = dataConn
+		} else {
+			netConn, err := dialer.Dial(network, address)
+			if err != nil {
+				return nil, err
+			}
+			conn = &deadlineConn{Conn: netConn, timeout: context.dataTimeout}
+		}
+		if tlsConfig != nil {
+			conn = tls.Client(conn, tlsConfig)
+		}
+		return conn, nil
+	}
+}
+
+// keepAlive sends a NOOP every 'keepAliveInterval' while the connection
+// is idle, like during the compression, so the server doesn't close it.
+// Call the returned function to stop it before using the connection.
+func (context *ServerContext) keepAlive() func() {
+	pinger, ok := context.remote.(remotePinger)
+	if !ok || context.keepAliveInterval <= 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(context.keepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := pinger.NoOp(); err != nil {
+					// Reconnected by the next operation
+					context.logger().Warn("Keepalive failed", "error", err)
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
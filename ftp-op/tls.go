@@ -0,0 +1,59 @@
+package ftpop
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLS modes accepted by the 'tlsMode' config key
+const (
+	tlsModeNone     = "none"
+	tlsModeExplicit = "explicit"
+	tlsModeImplicit = "implicit"
+)
+
+// tlsConfig returns the TLS configuration for the FTPS connection
+// or nil if TLS is disabled.
+func (context *ServerContext) tlsConfig() (*tls.Config, error) {
+	if context.tlsMode == tlsModeNone {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         context.hostAddress,
+		InsecureSkipVerify: context.tlsInsecureSkipVerify,
+		// Most servers require the data connection to reuse the
+		// TLS session of the control connection
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	// Custom CA bundle
+	if context.tlsCAFile != "" {
+		pem, err := ioutil.ReadFile(context.tlsCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in '%s'", context.tlsCAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	// Client certificate
+	if context.tlsCertFile != "" || context.tlsKeyFile != "" {
+		if context.tlsCertFile == "" || context.tlsKeyFile == "" {
+			return nil, errors.New("'tlsCertFile' and 'tlsKeyFile' must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(context.tlsCertFile, context.tlsKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,165 @@
+package ftpop
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// trashRunLayout is the name format of the trash directory of each run
+const trashRunLayout = "20060102T150405"
+
+// Trash areas, one for each root directory files are removed from
+const (
+	trashAreaSync     = "sync"
+	trashAreaCompress = "compress"
+)
+
+// startTrashRun sets the timestamped trash directory used by the current
+// 'Sync' or 'Compress' call and purges the expired ones.
+func (context *ServerContext) startTrashRun() error {
+	if context.trashDir == "" {
+		return nil
+	}
+
+	context.trashRunDir = filepath.Join(context.trashDir, time.Now().Format(trashRunLayout))
+	return context.purgeTrash()
+}
+
+// removeLocal removes a local file or directory. If 'trashDir' is set,
+// it's moved to '<trashDir>/<timestamp>/[<job>/]<area>/<relative path>'
+// instead.
+func (context *ServerContext) removeLocal(area string, localPath string) error {
+	if context.trashRunDir == "" {
+		return os.RemoveAll(localPath)
+	}
+
+	rootDir := context.syncLocalDir
+	if area == trashAreaCompress {
+		rootDir = context.compressDir
+	}
+	absoluteRootDir, err := filepath.Abs(rootDir)
+	if err != nil {
+		return err
+	}
+	absoluteLocalPath, err := filepath.Abs(localPath)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(absoluteRootDir, absoluteLocalPath)
+	if err != nil {
+		return err
+	}
+
+	trashPath := filepath.Join(context.trashRunDir, context.JobName, area, rel)
+	if err := ensureDirExist(filepath.Dir(trashPath)); err != nil {
+		return err
+	}
+
+	// The same path can be removed more than once in a run
+	if _, err := os.Lstat(trashPath); err == nil {
+		trashPath = fmt.Sprintf("%s.%d", trashPath, time.Now().UnixNano())
+	}
+
+	err = os.Rename(localPath, trashPath)
+	if errors.Is(err, syscall.EXDEV) {
+		// 'trashDir' is in another file system
+		if err = copyTree(localPath, trashPath); err == nil {
+			err = os.RemoveAll(localPath)
+		}
+	}
+	return err
+}
+
+// purgeTrash removes the trash directories older than 'trashRetentionDays'
+func (context *ServerContext) purgeTrash() error {
+	if context.trashRetentionDays <= 0 {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(context.trashDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	expiration := time.Now().AddDate(0, 0, -context.trashRetentionDays)
+	for _, entry := range entries {
+		runTime, err := time.ParseInLocation(trashRunLayout, entry.Name(), time.Local)
+		if err != nil || !entry.IsDir() || !runTime.Before(expiration) {
+			// Not created by a run or not expired
+			continue
+		}
+
+		trashRunPath := filepath.Join(context.trashDir, entry.Name())
+		if context.DryRun {
+			context.logger().Info("Would purge trash", "action", actionDelete, "path", trashRunPath)
+			continue
+		}
+		context.logger().Info("Purging trash", "action", actionDelete, "path", trashRunPath)
+		if err := os.RemoveAll(trashRunPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// isInsideDir returns 'true' if 'path' is 'dir' or is inside it
+func isInsideDir(path string, dir string) bool {
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	absoluteDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absoluteDir, absolutePath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// copyTree copies a file or a directory recursively keeping
+// the modification times.
+func copyTree(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return ensureDirExist(target)
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, in)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+}
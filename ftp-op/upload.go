@@ -0,0 +1,434 @@
+package ftpop
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Sync directions accepted by the 'direction' config key
+const (
+	directionDownload      = "download"
+	directionUpload        = "upload"
+	directionBidirectional = "bidirectional"
+)
+
+// uploadJob is a local file waiting to be uploaded
+type uploadJob struct {
+	localFilePath  string
+	localInfo      os.FileInfo
+	remoteFilePath string
+}
+
+// remoteDeletion is a remote file or directory that doesn't exist locally
+type remoteDeletion struct {
+	remotePath string
+	isDir      bool
+	// files is the number of files removed with it
+	files int
+}
+
+// planUpload walks the local directory and plans the upload of the new
+// and changed files and the deletion of the remote files that don't
+// exist locally. 'remoteExists' is false if 'remoteDir' is created by
+// the upload.
+func (context *ServerContext) planUpload(localDir string, remoteDir string, remoteExists bool, plan *syncPlan) error {
+	localEntries, err := context.readLocalDir(localDir)
+	if err != nil {
+		return newError(ErrList, "planUpload", localDir, err)
+	}
+	remoteEntries, err := context.readRemoteDir(remoteDir, remoteExists)
+	if err != nil {
+		return newError(ErrList, "planUpload", remoteDir, err)
+	}
+
+	// Delete remote entries that don't exist locally
+	for _, remoteEntry := range remoteEntries {
+		remoteEntryPath := fmt.Sprintf("%s/%s", remoteDir, remoteEntry.Name)
+		if !context.remoteEntryIsSynced(remoteEntry, remoteEntryPath) {
+			continue
+		}
+		if !remoteEntry.IsDir {
+			plan.remoteFiles++
+		}
+
+		localEntry := findLocalEntry(localEntries, remoteEntry.Name)
+		if localEntry != nil && localEntry.IsDir() == remoteEntry.IsDir {
+			continue
+		}
+		if err := context.planRemoteDeletion(remoteEntry, remoteEntryPath, plan); err != nil {
+			return err
+		}
+	}
+
+	for _, localEntry := range localEntries {
+		localEntryPath := fmt.Sprintf("%s/%s", localDir, localEntry.Name())
+		remoteEntryPath := fmt.Sprintf("%s/%s", remoteDir, localEntry.Name())
+		localEntryRelativePath := relativePath(context.syncLocalDir, localEntryPath)
+
+		// The remote entry is replaced if its type is different
+		remoteEntry := findRemoteEntry(remoteEntries, localEntry.Name())
+		if remoteEntry != nil && remoteEntry.IsDir != localEntry.IsDir() {
+			remoteEntry = nil
+		}
+
+		if localEntry.IsDir() {
+			// Skip excluded directories
+			if !context.filter.matchDir(localEntryRelativePath) {
+				context.logger().Debug("Dir excluded", "action", actionSkip, "path", localEntryPath)
+				continue
+			}
+
+			if remoteEntry == nil {
+				if context.DryRun {
+					context.logger().Info("Would create remote dir", "action", actionMakeDir, "path", remoteEntryPath)
+				}
+				plan.remoteDirs = append(plan.remoteDirs, remoteEntryPath)
+			}
+
+			// Recursive call if is a directory
+			if err := context.planUpload(localEntryPath, remoteEntryPath, remoteEntry != nil, plan); err != nil {
+				return err
+			}
+
+		} else {
+			// Skip excluded files
+			if !context.filter.matchFile(localEntryRelativePath) {
+				context.logger().Debug("File excluded", "action", actionSkip, "path", localEntryPath)
+				context.metrics().addFiles(actionSkip, 1)
+				continue
+			}
+
+			// Upload file if the local and remote file aren't equal
+			// or remote file doesn't exist
+			if context.localFileHasChange(localEntry, remoteEntry, localEntryRelativePath) {
+				if context.DryRun {
+					context.logger().Info("Would upload file", "action", actionUpload, "path", remoteEntryPath, "bytes", localEntry.Size())
+				}
+				plan.uploads = append(plan.uploads, &uploadJob{
+					localFilePath:  localEntryPath,
+					localInfo:      localEntry,
+					remoteFilePath: remoteEntryPath,
+				})
+			} else {
+				context.logger().Debug("File already exist", "action", actionSkip, "path", remoteEntryPath)
+				context.metrics().addFiles(actionSkip, 1)
+			}
+		}
+	}
+
+	return nil
+}
+
+// remoteDirExists returns 'true' if the remote root directory exists,
+// otherwise it's planned to be created. Any error other than a missing
+// directory is returned, the remote side can't be compared without it.
+func (context *ServerContext) remoteDirExists(remoteDir string, plan *syncPlan) (bool, error) {
+	entry, err := context.remote.Stat(remoteDir)
+	if err == nil {
+		if !entry.IsDir {
+			return false, newError(ErrList, "remoteDirExists", remoteDir, errors.New("not a directory"))
+		}
+		return true, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return false, newError(ErrList, "remoteDirExists", remoteDir, err)
+	}
+
+	if context.DryRun {
+		context.logger().Info("Would create remote dir", "action", actionMakeDir, "path", remoteDir)
+	}
+	plan.remoteDirs = append(plan.remoteDirs, remoteDir)
+	return false, nil
+}
+
+// localFileHasChange returns 'true' if the local file must be uploaded
+// to replace 'remoteEntry'.
+func (context *ServerContext) localFileHasChange(localInfo os.FileInfo, remoteEntry *RemoteEntry, relativeFilePath string) bool {
+	if remoteEntry == nil || remoteEntry.Size != uint64(localInfo.Size()) {
+		return true
+	}
+
+	// Both files didn't change since the last sync
+	record, err := context.state.getFile(relativeFilePath)
+	if err == nil && record != nil &&
+		record.Size == remoteEntry.Size &&
+		record.LocalTime.Equal(localInfo.ModTime()) &&
+		context.modTimeIsEqual(record.Time, remoteEntry.Time) {
+		return false
+	}
+
+	// Same modification time, set on the remote file by the upload
+	return !context.modTimeIsEqual(remoteEntry.Time, localInfo.ModTime())
+}
+
+// planRemoteDeletion plans the deletion of a remote file or directory
+// and counts the files removed with it.
+func (context *ServerContext) planRemoteDeletion(remoteEntry *RemoteEntry, remoteEntryPath string, plan *syncPlan) error {
+	if context.DryRun {
+		context.logger().Info("File not found on local. Would remove it", "action", actionDelete, "path", remoteEntryPath)
+	}
+
+	deletion := &remoteDeletion{remotePath: remoteEntryPath, isDir: remoteEntry.IsDir, files: 1}
+	if remoteEntry.IsDir {
+		var err error
+		deletion.files, err = context.countRemoteFiles(remoteEntryPath)
+		if err != nil {
+			return newError(ErrList, "planRemoteDeletion", remoteEntryPath, err)
+		}
+		plan.remoteFiles += deletion.files
+	}
+	plan.remoteDeletions = append(plan.remoteDeletions, deletion)
+	return nil
+}
+
+// applyRemoteDeletions deletes the remote files planned by 'planUpload'
+// and 'planBidirectional'
+func (context *ServerContext) applyRemoteDeletions(deletions []*remoteDeletion) error {
+	for _, deletion := range deletions {
+		context.logger().Info("File not found on local. Removing it", "action", actionDelete, "path", deletion.remotePath)
+
+		var err error
+		if deletion.isDir {
+			_, err = context.removeRemoteDir(deletion.remotePath)
+		} else {
+			err = context.remote.Remove(deletion.remotePath)
+		}
+		if err != nil {
+			return newError(ErrDelete, "applyRemoteDeletions", deletion.remotePath, err)
+		}
+		context.metrics().addFiles(actionDelete, deletion.files)
+	}
+
+	return nil
+}
+
+// removeRemoteDir removes a remote directory that doesn't exist locally,
+// keeping the files excluded from the sync inside it. Returns 'true' if
+// some files were kept.
+func (context *ServerContext) removeRemoteDir(remoteDir string) (bool, error) {
+	if context.filter.isEmpty() {
+		return false, context.remote.RemoveDir(remoteDir)
+	}
+
+	remoteEntries, err := context.remote.List(remoteDir)
+	if err != nil {
+		return false, err
+	}
+	kept := false
+	for _, remoteEntry := range remoteEntries {
+		remoteEntryPath := fmt.Sprintf("%s/%s", remoteDir, remoteEntry.Name)
+		if !context.remoteEntryIsSynced(remoteEntry, remoteEntryPath) {
+			kept = true
+			continue
+		}
+		if remoteEntry.IsDir {
+			subKept, err := context.removeRemoteDir(remoteEntryPath)
+			if err != nil {
+				return false, err
+			}
+			kept = kept || subKept
+		} else if err := context.remote.Remove(remoteEntryPath); err != nil {
+			return false, err
+		}
+	}
+
+	// Only remove the dir if nothing was kept
+	if kept {
+		return true, nil
+	}
+	return false, context.remote.RemoveDir(remoteDir)
+}
+
+// countRemoteFiles returns the number of files inside 'remoteDir' that
+// 'removeRemoteDir' would delete.
+func (context *ServerContext) countRemoteFiles(remoteDir string) (int, error) {
+	remoteEntries, err := context.remote.List(remoteDir)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, remoteEntry := range remoteEntries {
+		remoteEntryPath := fmt.Sprintf("%s/%s", remoteDir, remoteEntry.Name)
+		if !context.remoteEntryIsSynced(remoteEntry, remoteEntryPath) {
+			continue
+		}
+		if remoteEntry.IsDir {
+			subCount, err := context.countRemoteFiles(remoteEntryPath)
+			if err != nil {
+				return 0, err
+			}
+			count += subCount
+		} else if !isPartFile(remoteEntry.Name) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// remoteEntryIsSynced returns 'false' if the remote entry is excluded
+// from the sync by the filters.
+func (context *ServerContext) remoteEntryIsSynced(remoteEntry *RemoteEntry, remoteEntryPath string) bool {
+	remoteEntryRelativePath := relativePath(context.syncRemoteDir, remoteEntryPath)
+	if remoteEntry.IsDir {
+		return context.filter.matchDir(remoteEntryRelativePath)
+	}
+	return context.filter.matchFile(remoteEntryRelativePath)
+}
+
+// makeRemoteDirs creates the remote directories planned by 'planUpload'
+// and 'planBidirectional', parents first
+func (context *ServerContext) makeRemoteDirs(remoteDirs []string) error {
+	for _, remoteDir := range remoteDirs {
+		context.logger().Info("Creating remote dir", "action", actionMakeDir, "path", remoteDir)
+		if err := context.remote.MakeDir(remoteDir); err != nil {
+			return newError(ErrUpload, "makeRemoteDirs", remoteDir, err)
+		}
+	}
+	return nil
+}
+
+// uploadFiles uploads the planned files using the main connection
+func (context *ServerContext) uploadFiles(uploads []*uploadJob) error {
+	for _, job := range uploads {
+		context.logger().Debug("Uploading file", "action", actionUpload, "path", job.remoteFilePath, "bytes", job.localInfo.Size())
+
+		err := context.retryTransfer(context.remote, "uploadFile", job.remoteFilePath, func() error {
+			return context.uploadFile(job)
+		})
+		if err = context.handleError(err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uploadFile streams the local file to a partial file next to the remote
+// destination and only renames it into place when it's complete, so the
+// remote file is never a truncated file.
+func (context *ServerContext) uploadFile(job *uploadJob) error {
+	start := time.Now()
+	f, err := os.Open(job.localFilePath)
+	if err != nil {
+		return newError(ErrUpload, "uploadFile", job.localFilePath, err)
+	}
+
+	partFilePath := job.remoteFilePath + partFileSuffix
+	err = context.remote.Store(partFilePath, f)
+	f.Close()
+	if err != nil {
+		context.remote.Remove(partFilePath)
+		return newError(ErrUpload, "uploadFile", job.remoteFilePath, err)
+	}
+	if err := context.remote.Rename(partFilePath, job.remoteFilePath); err != nil {
+		return newError(ErrUpload, "uploadFile", job.remoteFilePath, err)
+	}
+
+	// Keep the local modification time if the server supports it
+	if setter, ok := context.remote.(remoteTimeSetter); ok {
+		err := setter.SetTime(job.remoteFilePath, job.localInfo.ModTime())
+		if err != nil && err != errSetTimeNotSupported {
+			context.logger().Warn("Can't set the modification time", "path", job.remoteFilePath, "error", err)
+		}
+	}
+
+	// Record the remote file as the server sees it
+	remoteEntry, err := context.remote.Stat(job.remoteFilePath)
+	if err != nil {
+		return newError(ErrUpload, "uploadFile", job.remoteFilePath, err)
+	}
+	if err := context.recordUpload(remoteEntry, job); err != nil {
+		return newError(ErrUpload, "uploadFile", job.remoteFilePath, err)
+	}
+
+	duration := time.Since(start)
+	context.logger().Info("Uploaded file", "action", actionUpload, "path", job.remoteFilePath,
+		"bytes", job.localInfo.Size(), "duration", duration)
+	context.metrics().observeFile(actionUpload, uint64(job.localInfo.Size()), duration)
+
+	return nil
+}
+
+// recordUpload stores the remote version and content hash of an
+// uploaded file in the state database.
+func (context *ServerContext) recordUpload(remoteEntry *RemoteEntry, job *uploadJob) error {
+	if context.state == nil {
+		return nil
+	}
+
+	localHash, err := getHashFromFile(job.localFilePath, "sha1")
+	if err != nil {
+		return err
+	}
+	return context.state.put(stateBucketFiles, relativePath(context.syncLocalDir, job.localFilePath), &fileState{
+		Size:       remoteEntry.Size,
+		Time:       remoteEntry.Time,
+		LocalTime:  job.localInfo.ModTime(),
+		Hash:       localHash,
+		UploadedAt: time.Now(),
+	})
+}
+
+// readLocalDir returns the entries of 'localDir' without the partial
+// downloads, or nothing if it doesn't exist.
+func (context *ServerContext) readLocalDir(localDir string) ([]os.FileInfo, error) {
+	items, err := ioutil.ReadDir(localDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]os.FileInfo, 0, len(items))
+	for _, item := range items {
+		if !item.IsDir() && context.isPartialDownload(fmt.Sprintf("%s/%s", localDir, item.Name())) {
+			continue
+		}
+		entries = append(entries, item)
+	}
+	return entries, nil
+}
+
+// readRemoteDir returns the entries of 'remoteDir' without the partial
+// uploads, or nothing if it doesn't exist.
+func (context *ServerContext) readRemoteDir(remoteDir string, remoteExists bool) ([]*RemoteEntry, error) {
+	if !remoteExists {
+		return nil, nil
+	}
+
+	items, err := context.remote.List(remoteDir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*RemoteEntry, 0, len(items))
+	for _, item := range items {
+		if !item.IsDir && isPartFile(item.Name) {
+			continue
+		}
+		entries = append(entries, item)
+	}
+	return entries, nil
+}
+
+func findLocalEntry(localEntries []os.FileInfo, name string) os.FileInfo {
+	for _, localEntry := range localEntries {
+		if localEntry.Name() == name {
+			return localEntry
+		}
+	}
+	return nil
+}
+
+func findRemoteEntry(remoteEntries []*RemoteEntry, name string) *RemoteEntry {
+	for _, remoteEntry := range remoteEntries {
+		if remoteEntry.Name == name {
+			return remoteEntry
+		}
+	}
+	return nil
+}
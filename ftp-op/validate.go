@@ -0,0 +1,143 @@
+package ftpop
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// ValidationError lists all the problems found in a config file
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0]
+	}
+	return fmt.Sprintf("%d problems found:\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
+
+// Validate reads the config file and checks all its values without
+// connecting to the remote server. The returned error lists all the
+// problems found, use errors.As to get the '*ValidationError'.
+func (context *ServerContext) Validate() error {
+	return context.readConfig()
+}
+
+// configReader reads typed values from the config and collects the
+// problems found instead of stopping at the first one.
+type configReader struct {
+	config   *viper.Viper
+	problems []string
+}
+
+func (reader *configReader) problem(format string, args ...interface{}) {
+	reader.problems = append(reader.problems, fmt.Sprintf(format, args...))
+}
+
+// err returns the problems found as a '*ValidationError', if any
+func (reader *configReader) err() error {
+	if len(reader.problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: reader.problems}
+}
+
+func (reader *configReader) isSet(key string) bool {
+	return reader.config.Get(key) != nil
+}
+
+// required returns the non-empty string value of 'key'
+func (reader *configReader) required(key string) string {
+	if !reader.isSet(key) {
+		reader.problem("variable '%s' not found in config file", key)
+		return ""
+	}
+	value := reader.str(key)
+	if strings.TrimSpace(value) == "" {
+		reader.problem("variable '%s' can't be empty", key)
+	}
+	return value
+}
+
+func (reader *configReader) str(key string) string {
+	value, err := cast.ToStringE(reader.config.Get(key))
+	if err != nil {
+		reader.problem("invalid '%s' value '%v' (expected a string)", key, reader.config.Get(key))
+	}
+	return value
+}
+
+// integer returns the value of 'key' and 'false' if it's not an integer
+func (reader *configReader) integer(key string) (int, bool) {
+	value, err := cast.ToIntE(reader.config.Get(key))
+	if err != nil {
+		reader.problem("invalid '%s' value '%v' (expected an integer)", key, reader.config.Get(key))
+		return 0, false
+	}
+	return value, true
+}
+
+// number returns the value of 'key' and 'false' if it's not a number
+func (reader *configReader) number(key string) (float64, bool) {
+	value, err := cast.ToFloat64E(reader.config.Get(key))
+	if err != nil {
+		reader.problem("invalid '%s' value '%v' (expected a number)", key, reader.config.Get(key))
+		return 0, false
+	}
+	return value, true
+}
+
+func (reader *configReader) boolean(key string) bool {
+	value, err := cast.ToBoolE(reader.config.Get(key))
+	if err != nil {
+		reader.problem("invalid '%s' value '%v' (expected true or false)", key, reader.config.Get(key))
+	}
+	return value
+}
+
+func (reader *configReader) duration(key string) time.Duration {
+	value, err := time.ParseDuration(reader.str(key))
+	if err != nil || value < 0 {
+		reader.problem("invalid '%s' value '%v' (expected a duration like '90s' or '1m')", key, reader.config.Get(key))
+	}
+	return value
+}
+
+func (reader *configReader) stringSlice(key string) []string {
+	if !reader.isSet(key) {
+		return nil
+	}
+	value, err := cast.ToStringSliceE(reader.config.Get(key))
+	if err != nil {
+		reader.problem("invalid '%s' value '%v' (expected a list of strings)", key, reader.config.Get(key))
+	}
+	return value
+}
+
+// oneOf returns the lower case value of 'key', which must be one of
+// 'allowed'
+func (reader *configReader) oneOf(key string, allowed ...string) string {
+	value := strings.ToLower(reader.str(key))
+	for _, allowedValue := range allowed {
+		if value == allowedValue {
+			return value
+		}
+	}
+	expected := strings.Join(allowed[:len(allowed)-1], "', '") + "' or '" + allowed[len(allowed)-1]
+	reader.problem("invalid '%s' value '%s' (expected '%s')", key, value, expected)
+	return value
+}
+
+// file checks that the file set in 'key' exists, if any
+func (reader *configReader) file(key string) string {
+	path := reader.str(key)
+	if path != "" && !fileExists(path) {
+		reader.problem("file '%s' of '%s' not found", path, key)
+	}
+	return path
+}
@@ -0,0 +1,51 @@
+package ftpop
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	dir := t.TempDir()
+	configFilePath := filepath.Join(dir, "server.yml")
+	config := `
+hostAddress: ftp.example.com
+hostPort: 70000
+hostUser: user
+hostPassword: password
+syncRemoteDir: /data
+syncLocalDir: ` + filepath.Join(dir, "mirror") + `
+compressDir: ` + filepath.Join(dir, "compressed") + `
+parallelDownloads: 0
+verifyMode: checksum
+dialTimeout: soon
+deleteGuardMaxPercent: 120
+downloadRateLimit: fast
+`
+	if err := os.WriteFile(configFilePath, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	context := &ServerContext{ConfigFilePath: configFilePath}
+	err := context.Validate()
+	if !errors.Is(err, ErrConfig) {
+		t.Fatalf("got %v, want ErrConfig", err)
+	}
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("got %v, want a *ValidationError", err)
+	}
+
+	wantKeys := []string{"hostPort", "parallelDownloads", "verifyMode", "dialTimeout", "deleteGuardMaxPercent", "downloadRateLimit"}
+	if len(validationErr.Problems) != len(wantKeys) {
+		t.Errorf("got %d problems, want %d: %v", len(validationErr.Problems), len(wantKeys), validationErr.Problems)
+	}
+	for _, key := range wantKeys {
+		if !strings.Contains(err.Error(), "'"+key+"'") {
+			t.Errorf("no problem reported for '%s' in %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package ftpop
+
+import (
+	"os"
+	"time"
+)
+
+// Verify modes accepted by the 'verifyMode' config key
+const (
+	verifyModeSize = "size"
+	verifyModeHash = "hash"
+)
+
+// verifyTimePrecision is the worst precision of the modification time
+// listed by the servers for recent files. A file downloaded within it
+// could have changed later without changing its listed time.
+const verifyTimePrecision = time.Minute
+
+// hashHasChange is the 'fileHasChange' of the 'hash' verify mode. It
+// compares the local file with the hash computed by the server if it
+// supports hash commands, otherwise with the hash stored in the state
+// database when the file was downloaded.
+func (context *ServerContext) hashHasChange(remoteEntry *RemoteEntry, remoteFilePath string, destinationLocalFilePath string) bool {
+	fileStat, err := os.Stat(destinationLocalFilePath)
+	if err != nil || fileStat.IsDir() || remoteEntry.Size != uint64(fileStat.Size()) {
+		return true
+	}
+
+	// Hash computed by the server
+	if hasher, ok := context.remote.(remoteHasher); ok {
+		algorithm, remoteHash, err := hasher.Hash(remoteFilePath)
+		if err == nil {
+			localHash, err := getHashFromFile(destinationLocalFilePath, algorithm)
+			return err != nil || localHash != remoteHash
+		}
+		if err != errHashNotSupported {
+			context.logger().Warn("Can't get the hash from the server. Using the state database", "path", remoteFilePath, "error", err)
+		}
+	}
+
+	// Hash stored in the state database
+	record, err := context.state.getFile(relativePath(context.syncRemoteDir, remoteFilePath))
+	if err != nil || record == nil || record.Size != remoteEntry.Size || !context.modTimeIsEqual(record.Time, remoteEntry.Time) {
+		return true
+	}
+	if record.DownloadedAt.Before(remoteEntry.Time.Add(verifyTimePrecision)) {
+		// Downloaded too close to the listed time, download it again
+		// to be sure it didn't change after that
+		return true
+	}
+	localHash, err := getHashFromFile(destinationLocalFilePath, "sha1")
+	return err != nil || localHash != record.Hash
+}
+
+// recordDownload stores the remote version and the sha1 'localHash' of
+// a downloaded file in the state database.
+func (context *ServerContext) recordDownload(remoteEntry *RemoteEntry, remoteFilePath string, localHash string) error {
+	if context.state == nil {
+		return nil
+	}
+
+	relativeFilePath := relativePath(context.syncRemoteDir, remoteFilePath)
+	err := context.state.put(stateBucketFiles, relativeFilePath, &fileState{
+		Size:         remoteEntry.Size,
+		Time:         remoteEntry.Time,
+		LocalTime:    remoteEntry.Time,
+		Hash:         localHash,
+		DownloadedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return context.state.delete(stateBucketPartials, relativeFilePath)
+}